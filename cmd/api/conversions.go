@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+// clickCookieName is the name of the cookie holding the click ID of a visitor's last visit.
+const clickCookieName = "shrtnr_click"
+
+// pixelGIF is a transparent 1x1 GIF image.
+var pixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// trackClick hands the visitor the click ID of their visit, so that later conversions can be
+// attributed to it. The click ID is set as a cookie and, if configured, appended to the
+// destination as a query parameter. It returns the destination to redirect to.
+func (app *application) trackClick(w http.ResponseWriter, r *http.Request, visit *data.Visit, destination string) string {
+	cookie := &http.Cookie{
+		Name:     clickCookieName,
+		Value:    visit.ID.String(),
+		Path:     "/",
+		MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	// The pixel is embedded in other sites, so the cookie has to be sent on cross-site requests.
+	// Browsers only accept such cookies over HTTPS, and drop them altogether when they're marked
+	// Secure but set over plain HTTP, so the pixel only works cross-site when served over HTTPS.
+	if app.isHTTPS(r) {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+
+	http.SetCookie(w, cookie)
+
+	if app.config.conversions.clickIDParam == "" {
+		return destination
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	qs := u.Query()
+	qs.Set(app.config.conversions.clickIDParam, visit.ID.String())
+	u.RawQuery = qs.Encode()
+
+	return u.String()
+}
+
+// readClickID reads the click ID a conversion is attributed to, from the click_id query
+// parameter or otherwise the click cookie.
+func (app *application) readClickID(r *http.Request) (uuid.UUID, error) {
+	clickID := r.URL.Query().Get("click_id")
+
+	if clickID == "" {
+		cookie, err := r.Cookie(clickCookieName)
+		if err != nil {
+			return uuid.Nil, errors.New("missing click id")
+		}
+		clickID = cookie.Value
+	}
+
+	id, err := uuid.Parse(clickID)
+	if err != nil {
+		return uuid.Nil, errors.New("invalid click id")
+	}
+
+	return id, nil
+}
+
+// conversionPixelHandler records a conversion from a tracking pixel embedded in the page a
+// visitor reaches on completing a goal. It always responds with the pixel image, as there is
+// nobody to show an error to.
+func (app *application) conversionPixelHandler(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+		w.WriteHeader(http.StatusOK)
+
+		if _, err := w.Write(pixelGIF); err != nil {
+			app.logError(r, err)
+		}
+	}()
+
+	clickID, err := app.readClickID(r)
+	if err != nil {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	conversion := &data.Conversion{
+		VisitID: clickID,
+		Goal:    app.readStrings(qs, "goal", data.DefaultGoal),
+	}
+
+	if value := qs.Get("value"); value != "" {
+		conversion.Value, err = strconv.ParseFloat(value, 64)
+		v.Check(err == nil, "value", "must be a number")
+	}
+
+	if data.ValidateConversion(v, conversion); !v.Valid() {
+		return
+	}
+
+	err = app.models.Conversions.Insert(conversion)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) createConversionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ClickID uuid.UUID `json:"click_id"`
+		Goal    string    `json:"goal"`
+		Value   float64   `json:"value"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Goal == "" {
+		input.Goal = data.DefaultGoal
+	}
+
+	conversion := &data.Conversion{
+		VisitID: input.ClickID,
+		Goal:    input.Goal,
+		Value:   input.Value,
+	}
+
+	v := validator.New()
+
+	if data.ValidateConversion(v, conversion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Conversions.Insert(conversion)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("click_id", "does not match a visit")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"conversion": conversion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
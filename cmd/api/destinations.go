@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+// readDestination reads the split destination a request is made against, responding with the
+// appropriate error and returning nil if it doesn't exist.
+func (app *application) readDestination(w http.ResponseWriter, r *http.Request) *data.LinkDestination {
+	link := app.readLink(w, r)
+	if link == nil {
+		return nil
+	}
+
+	destinationID, err := app.readUUIDParam(r, "destination_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	destination, err := app.models.Destinations.Get(link.ID, destinationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return destination
+}
+
+func (app *application) listLinkDestinationsHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	destinations, err := app.models.Destinations.GetAllForLink(link.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"destinations": destinations}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createLinkDestinationHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	var input struct {
+		Destination string `json:"destination"`
+		Weight      int    `json:"weight"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	destination := &data.LinkDestination{
+		LinkID:      link.ID,
+		Destination: input.Destination,
+		Weight:      input.Weight,
+	}
+
+	v := validator.New()
+
+	if data.ValidateLinkDestination(v, destination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Destinations.Insert(destination)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/links/%s/destinations/%s", link.ID, destination.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"destination": destination}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showLinkDestinationHandler(w http.ResponseWriter, r *http.Request) {
+	destination := app.readDestination(w, r)
+	if destination == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"destination": destination}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateLinkDestinationHandler(w http.ResponseWriter, r *http.Request) {
+	destination := app.readDestination(w, r)
+	if destination == nil {
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(destination.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	// Use pointers so that we can use their zero values of nil as part of the partial record
+	// update logic.
+	var input struct {
+		Destination *string `json:"destination"`
+		Weight      *int    `json:"weight"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Destination != nil {
+		destination.Destination = *input.Destination
+	}
+
+	if input.Weight != nil {
+		destination.Weight = *input.Weight
+	}
+
+	v := validator.New()
+
+	if data.ValidateLinkDestination(v, destination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Destinations.Update(destination)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"destination": destination}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteLinkDestinationHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	destinationID, err := app.readUUIDParam(r, "destination_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Destinations.Delete(link.ID, destinationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "destination successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/dnsverify"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+const (
+	// domainBatchSize is the maximum number of domains checked at a time by the verifier.
+	domainBatchSize = 50
+
+	// domainRecheckDelay is the minimum time between checks of a pending domain by the verifier.
+	domainRecheckDelay = 5 * time.Minute
+
+	// domainLookupTimeout is how long the lookup of a domain's challenge record may take.
+	domainLookupTimeout = 10 * time.Second
+)
+
+// checkDomain looks up a pending domain's challenge record and records the outcome.
+func (app *application) checkDomain(domain *data.Domain) error {
+	ctx, cancel := context.WithTimeout(context.Background(), domainLookupTimeout)
+	checkErr := dnsverify.Verify(ctx, app.resolver, domain.Hostname, domain.VerificationToken)
+	cancel()
+
+	return app.models.Domains.RecordCheck(domain, checkErr, app.config.domains.verifyWindow)
+}
+
+// verifyDomains checks the challenge records of the pending domains which are due a check.
+func (app *application) verifyDomains() error {
+	for {
+		domains, err := app.models.Domains.ClaimPending(domainBatchSize, domainRecheckDelay)
+		if err != nil {
+			return err
+		}
+
+		for _, domain := range domains {
+			err := app.checkDomain(domain)
+			if err != nil && !errors.Is(err, data.ErrEditConflict) {
+				return err
+			}
+
+			switch domain.Status {
+			case data.DomainVerified:
+				app.logger.Info().Str("domain", domain.Hostname).Msg("domain verified")
+			case data.DomainFailed:
+				app.logger.Warn().Str("domain", domain.Hostname).Str("error", domain.VerificationError).Msg("domain verification failed")
+			}
+		}
+
+		// Stop once every due domain has been checked, or the server starts shutting down.
+		if len(domains) < domainBatchSize {
+			return nil
+		}
+
+		select {
+		case <-app.done:
+			return nil
+		default:
+		}
+	}
+}
+
+// readDomainParam reads the domain a request is made against, responding with the appropriate
+// error and returning nil if it doesn't exist.
+func (app *application) readDomainParam(w http.ResponseWriter, r *http.Request) *data.Domain {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	domain, err := app.models.Domains.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return domain
+}
+
+func (app *application) listDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "hostname")
+
+	input.Filters.SortSafeList = []string{"hostname", "created_at", "-hostname", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	domains, metadata, err := app.models.Domains.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"domains": domains, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createDomainHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Hostname    string `json:"hostname"`
+		FallbackURL string `json:"fallback_url"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	domain := &data.Domain{
+		Hostname:    strings.ToLower(strings.TrimSuffix(input.Hostname, ".")),
+		FallbackURL: input.FallbackURL,
+	}
+
+	v := validator.New()
+
+	v.Check(domain.Hostname != app.config.shortLinks.hostname, "hostname", "must not be the default domain")
+
+	if data.ValidateDomain(v, domain); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Domains.Insert(domain)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateHostname):
+			v.AddError("hostname", "a domain with this hostname already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/domains/%s", domain.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"domain": domain}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := app.readDomainParam(w, r)
+	if domain == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"domain": domain}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := app.readDomainParam(w, r)
+	if domain == nil {
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(domain.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	// Use pointers so that we can use their zero values of nil as part of the partial record
+	// update logic.
+	var input struct {
+		FallbackURL *string `json:"fallback_url"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.FallbackURL != nil {
+		domain.FallbackURL = *input.FallbackURL
+	}
+
+	v := validator.New()
+
+	if data.ValidateDomain(v, domain); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Domains.Update(domain)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"domain": domain}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteDomainHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Domains.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDomainInUse):
+			app.failedValidationResponse(w, r, map[string]string{"domain": "still has links, which must be deleted or moved first"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "domain successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyDomainHandler checks a domain's challenge record straight away, rather than waiting for
+// the verifier. Failed domains are moved back to pending, starting a new verification window.
+func (app *application) verifyDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := app.readDomainParam(w, r)
+	if domain == nil {
+		return
+	}
+
+	if domain.Status == data.DomainFailed {
+		err := app.models.Domains.RestartVerification(domain)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	if domain.Status == data.DomainPending {
+		err := app.checkDomain(domain)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"domain": domain}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
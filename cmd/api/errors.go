@@ -3,13 +3,61 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 )
 
+// problemTypePrefix is prefixed to the error code of a problem to form its type URI.
+const problemTypePrefix = "urn:shrtnr:problem:"
+
+// invalidParam is a field which failed validation, listed in the invalid_params of a problem.
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.Error().Str("request_method", r.Method).Str("request_url", r.URL.String()).Err(err).Msg("")
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
+// wantsProblem reports whether the client accepts application/problem+json, in which case errors
+// are sent as RFC 7807 problem details rather than {"error": ...}.
+func (app *application) wantsProblem(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(mediaType), "application/problem+json") {
+				continue
+			}
+
+			// Ignore the media type if the client explicitly refuses it.
+			refused := false
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") && strings.Trim(value, "0.") == "" {
+					refused = true
+				}
+			}
+
+			if !refused {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// errorResponse sends an error to the client. The message is either a string or, for validation
+// failures, a map of fields to what is wrong with them.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	if app.wantsProblem(r) {
+		app.problemResponse(w, r, status, code, message)
+		return
+	}
+
 	env := envelope{"error": message}
 
 	err := app.writeJSON(w, status, env, nil)
@@ -19,64 +67,101 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// problemResponse sends an error as an RFC 7807 problem details object, extended with the stable
+// code of the error and, for validation failures, the invalid_params.
+func (app *application) problemResponse(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
+	env := envelope{
+		"type":     problemTypePrefix + code,
+		"title":    http.StatusText(status),
+		"status":   status,
+		"instance": r.URL.RequestURI(),
+		"code":     code,
+	}
+
+	switch message := message.(type) {
+	case map[string]string:
+		params := make([]invalidParam, 0, len(message))
+		for name, reason := range message {
+			params = append(params, invalidParam{Name: name, Reason: reason})
+		}
+		sort.Slice(params, func(i, j int) bool {
+			return params[i].Name < params[j].Name
+		})
+
+		env["detail"] = "one or more parameters are invalid"
+		env["invalid_params"] = params
+	default:
+		env["detail"] = fmt.Sprint(message)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/problem+json")
+
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, 500, message)
+	app.errorResponse(w, r, 500, "server_error", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "validation_failed", errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limited exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_authentication_token", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication_required", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "inactive_account", message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "not_permitted", message)
 }
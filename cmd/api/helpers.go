@@ -4,19 +4,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/matthewsaunders/link-shortener-api/internal/qr"
 	"github.com/matthewsaunders/link-shortener-api/internal/validator"
 )
 
 type envelope map[string]interface{}
 
+// sourceRX matches the visit sources which are recorded.
+var sourceRX = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
@@ -28,6 +38,18 @@ func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
 	return id, nil
 }
 
+// readUUIDParam reads a UUID from the named URL parameter.
+func (app *application) readUUIDParam(r *http.Request, name string) (uuid.UUID, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := uuid.Parse(params.ByName(name))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid %s parameter", name)
+	}
+
+	return id, nil
+}
+
 func (app *application) readTokenParam(r *http.Request) (string, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
@@ -39,6 +61,114 @@ func (app *application) readTokenParam(r *http.Request) (string, error) {
 	return token, nil
 }
 
+// readRemoteIP returns the IP address of the client which made the request. X-Forwarded-For is
+// only believed when the request comes from one of the -trusted-proxies, in which case the
+// addresses it lists are walked back from the nearest until one isn't a trusted proxy, as anything
+// further along could have been forged by the client.
+func (app *application) readRemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !app.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = forwarded[i]
+		if !app.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// isHTTPS reports whether the client made the request over HTTPS, either to the API itself or to
+// one of the -trusted-proxies which set X-Forwarded-Proto.
+func (app *application) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return app.isTrustedProxy(ip) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// isTrustedProxy reports whether ip is within one of the -trusted-proxies.
+func (app *application) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range app.config.proxies.trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readAcceptLanguages returns the language tags of the request's Accept-Language header, most
+// preferred first. The wildcard and languages with a quality of 0 are left out.
+func (app *application) readAcceptLanguages(r *http.Request) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	languages := []language{}
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.tag
+	}
+
+	return tags
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -52,7 +182,9 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if headers.Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 
 	if _, err := w.Write(js); err != nil {
@@ -211,6 +343,105 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool is a helper method on application type that reads a string value from the URL query
+// string and converts it to a boolean before returning. If no matching key is found then it
+// returns the provided default value. If the value couldn't be converted to a boolean, then we
+// record an error message in the provided Validator instance, and return the default value.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// readDate is a helper method on application type that reads a YYYY-MM-DD date from the URL query
+// string. If no matching key is found then it returns the provided default value. If the value
+// couldn't be parsed as a date, then we record an error message in the provided Validator
+// instance, and return the default value.
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a date in the format YYYY-MM-DD")
+		return defaultValue
+	}
+
+	return t
+}
+
+// readTime is a helper method on application type that reads an RFC 3339 timestamp or a
+// YYYY-MM-DD date from the URL query string. Dates are read as midnight UTC, or as the end of the
+// day if endOfDay is true. If no matching key is found then it returns the zero time. If the value
+// couldn't be parsed, then we record an error message in the provided Validator instance.
+func (app *application) readTime(qs url.Values, key string, endOfDay bool, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp or a date in the format YYYY-MM-DD")
+		return time.Time{}
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t
+}
+
+// readColor is a helper method on application type that reads a RRGGBB hex colour from the URL
+// query string. If no matching key is found then it returns the provided default value. If the
+// value couldn't be parsed as a colour, then we record an error message in the provided Validator
+// instance, and return the default value.
+func (app *application) readColor(qs url.Values, key string, defaultValue color.RGBA, v *validator.Validator) color.RGBA {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	c, err := qr.ParseColor(s)
+	if err != nil {
+		v.AddError(key, "must be a hex colour in the format RRGGBB")
+		return defaultValue
+	}
+
+	return c
+}
+
+// readSource reads the source a visit was made from, e.g. a QR code scan, from the source query
+// string parameter. Values which aren't a short lowercase identifier are ignored, as a malformed
+// parameter shouldn't stop a visitor from being redirected.
+func (app *application) readSource(r *http.Request) string {
+	source := r.URL.Query().Get("source")
+	if !validator.Matches(source, sourceRX) {
+		return ""
+	}
+	return source
+}
+
 // background is a helper that accepts an arbitrary function as a parameter and runs it in a
 // in goroutine in the background.
 func (app *application) background(fn func()) {
@@ -232,3 +463,25 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// runPeriodically is a helper that runs fn in the background once immediately and then every
+// interval, until the application starts shutting down. Errors returned by fn are logged and do
+// not stop the loop.
+func (app *application) runPeriodically(name string, interval time.Duration, fn func() error) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := fn(); err != nil {
+				app.logger.Error().Str("job", name).Err(err).Msg("")
+			}
+
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
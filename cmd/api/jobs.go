@@ -0,0 +1,161 @@
+package main
+
+import "time"
+
+// visitPartitionsAhead is the number of monthly visit partitions created ahead of the current
+// month.
+const visitPartitionsAhead = 3
+
+// geoipReloadInterval is how often the GeoIP database file is checked for changes.
+const geoipReloadInterval = time.Minute
+
+// linkCountInterval is how often recorded visits are added to the links' visit counters, and so
+// roughly how far the counters lag behind.
+const linkCountInterval = 5 * time.Second
+
+// linkStatsInterval is how often the links' visits over the last seven days are recounted, as
+// days fall out of the window.
+const linkStatsInterval = 10 * time.Minute
+
+// liveCounterPruneInterval is how often the live visit counters of links nobody watches any more
+// are discarded.
+const liveCounterPruneInterval = time.Minute
+
+// certReloadInterval is how often the TLS certificate files are checked for changes.
+const certReloadInterval = time.Minute
+
+// startJobs starts the periodic background jobs. Each job is tracked by app.wg and stops once
+// the server begins shutting down.
+func (app *application) startJobs() {
+	if app.config.rollups.interval > 0 {
+		app.runPeriodically("visit_rollup", app.config.rollups.interval, app.rollUpVisits)
+	}
+
+	if app.config.visits.partitionInterval > 0 {
+		app.runPeriodically("visit_partitions", app.config.visits.partitionInterval, app.maintainVisitPartitions)
+	}
+
+	app.runPeriodically("link_counts", linkCountInterval, app.countLinkVisits)
+	app.runPeriodically("link_stats", linkStatsInterval, app.refreshLinkStats)
+
+	app.runPeriodically("live_counter_prune", liveCounterPruneInterval, app.pruneLiveCounters)
+
+	app.runPeriodically("outbox_relay", app.config.outbox.interval, app.relayOutbox)
+
+	if app.config.webhooks.interval > 0 {
+		app.runPeriodically("webhook_deliveries", app.config.webhooks.interval, app.deliverWebhooks)
+	}
+
+	if app.config.domains.verifyInterval > 0 {
+		app.runPeriodically("domain_verification", app.config.domains.verifyInterval, app.verifyDomains)
+	}
+
+	if app.geoip != nil {
+		app.runPeriodically("geoip_reload", geoipReloadInterval, app.reloadGeoIP)
+	}
+
+	if app.certs != nil {
+		app.runPeriodically("tls_reload", certReloadInterval, app.reloadCerts)
+	}
+}
+
+// rollUpVisits folds newly closed hours of visits into the rollup tables.
+func (app *application) rollUpVisits() error {
+	until, err := app.models.Visits.RollUp()
+	if err != nil {
+		return err
+	}
+
+	app.logger.Debug().Time("rolled_up_until", until).Msg("rolled up visits")
+
+	return nil
+}
+
+// maintainVisitPartitions creates the upcoming monthly partitions of the visits table and, when a
+// retention period is configured, drops the partitions which have expired.
+func (app *application) maintainVisitPartitions() error {
+	created, err := app.models.Visits.CreatePartitions(visitPartitionsAhead)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range created {
+		app.logger.Info().Str("partition", name).Msg("created visits partition")
+	}
+
+	if app.config.visits.retentionDays <= 0 {
+		return nil
+	}
+
+	dropped, err := app.models.Visits.DropExpiredPartitions(app.config.visits.retentionDays)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range dropped {
+		app.logger.Info().Str("partition", name).Msg("dropped visits partition")
+	}
+
+	return nil
+}
+
+// countLinkVisits adds the visits recorded since the last run to the links' visit counters.
+func (app *application) countLinkVisits() error {
+	counted, err := app.models.Links.CountVisits()
+	if err != nil {
+		return err
+	}
+
+	app.logger.Debug().Int64("visits", counted).Msg("counted link visits")
+
+	return nil
+}
+
+// refreshLinkStats recounts the visits of the last seven days of links whose count has changed.
+func (app *application) refreshLinkStats() error {
+	recounted, err := app.models.Links.RefreshRecentVisits()
+	if err != nil {
+		return err
+	}
+
+	app.logger.Debug().Int64("links", recounted).Msg("recounted recent link visits")
+
+	return nil
+}
+
+// pruneLiveCounters discards the live visit counters of links nobody has watched for an hour.
+func (app *application) pruneLiveCounters() error {
+	pruned := app.counters.Prune(time.Now())
+
+	app.logger.Debug().Int("links", pruned).Msg("pruned live counters")
+
+	return nil
+}
+
+// reloadGeoIP reloads the GeoIP database if its file has changed.
+func (app *application) reloadGeoIP() error {
+	reloaded, err := app.geoip.Reload()
+	if err != nil {
+		return err
+	}
+
+	if reloaded {
+		app.logger.Info().Str("path", app.config.geoip.db).Msg("reloaded GeoIP database")
+	}
+
+	return nil
+}
+
+// reloadCerts reloads the TLS certificates if any of their files have changed.
+func (app *application) reloadCerts() error {
+	reloaded, err := app.certs.Reload()
+	if err != nil {
+		return err
+	}
+
+	if reloaded {
+		app.logger.Info().Msg("reloaded TLS certificates")
+	}
+
+	return nil
+}
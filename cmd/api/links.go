@@ -5,30 +5,61 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/google/uuid"
 	"github.com/matthewsaunders/link-shortener-api/internal/data"
 	"github.com/matthewsaunders/link-shortener-api/internal/validator"
 )
 
 func (app *application) listLinksHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Name string
+		data.LinkFilter
 		data.Filters
 	}
 
 	v := validator.New()
 	qs := r.URL.Query()
 
-	input.Name = app.readStrings(qs, "name", "")
+	input.LinkFilter.Name = app.readStrings(qs, "name", "")
+	input.LinkFilter.Query = strings.TrimSpace(app.readStrings(qs, "q", ""))
+	input.LinkFilter.CreatedAfter = app.readTime(qs, "created_after", false, v)
+	input.LinkFilter.CreatedBefore = app.readTime(qs, "created_before", false, v)
+
+	// Links on the default domain are filtered for by its hostname.
+	input.LinkFilter.Domain = strings.ToLower(app.readStrings(qs, "domain", ""))
+	if input.LinkFilter.Domain == app.config.shortLinks.hostname {
+		input.LinkFilter.Domain = ""
+		input.LinkFilter.DefaultDomain = true
+	}
+
+	// Searches are sorted by relevance unless another sort is asked for.
+	defaultSort := "id"
+	if input.LinkFilter.Query != "" {
+		defaultSort = "relevance"
+	}
+
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Filters.Sort = app.readStrings(qs, "sort", "id")
+	input.Filters.Sort = app.readStrings(qs, "sort", defaultSort)
+	input.Filters.Cursor = app.readStrings(qs, "cursor", "")
+	input.Filters.CursorKey = app.cursorKey
+	input.Filters.CursorScope = input.LinkFilter.Query
 
 	input.Filters.SortSafeList = []string{
 		// ascending sort values
-		"id", "name", "created_at", "updated_at",
+		"id", "name", "created_at", "updated_at", "total_visits", "visits_7d", "last_visited_at",
 		// descending sort values
-		"-id", "-name", "-created_at", "-updated_at",
+		"-id", "-name", "-created_at", "-updated_at", "-total_visits", "-visits_7d", "-last_visited_at",
+		// most relevant to q first
+		"relevance",
+	}
+
+	v.Check(input.Filters.Sort != "relevance" || input.LinkFilter.Query != "", "sort", "relevance requires q")
+	v.Check(len(input.LinkFilter.Query) <= 200, "q", "must not be more than 200 bytes long")
+
+	if !input.LinkFilter.CreatedAfter.IsZero() && !input.LinkFilter.CreatedBefore.IsZero() {
+		v.Check(input.LinkFilter.CreatedBefore.After(input.LinkFilter.CreatedAfter), "created_before", "must be after created_after")
 	}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -36,7 +67,7 @@ func (app *application) listLinksHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	links, metadata, err := app.models.Links.GetAll(input.Name, input.Filters)
+	links, metadata, err := app.models.Links.GetAll(input.LinkFilter, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -50,9 +81,10 @@ func (app *application) listLinksHandler(w http.ResponseWriter, r *http.Request)
 
 func (app *application) createLinkHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Name        string `json:"name"`
-		Destination string `json:"destination"`
-		Token       string `json:"token"`
+		Name        string     `json:"name"`
+		Destination string     `json:"destination"`
+		Token       string     `json:"token"`
+		DomainID    *uuid.UUID `json:"domain_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -70,6 +102,7 @@ func (app *application) createLinkHandler(w http.ResponseWriter, r *http.Request
 		Name:        input.Name,
 		Destination: input.Destination,
 		Token:       input.Token,
+		DomainID:    input.DomainID,
 	}
 
 	v := validator.New()
@@ -79,9 +112,19 @@ func (app *application) createLinkHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !app.checkLinkDomain(w, r, link) {
+		return
+	}
+
 	err = app.models.Links.Insert(link)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateToken):
+			v.AddError("token", "a link with this token already exists on this domain")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -146,9 +189,10 @@ func (app *application) updateLinkHandler(w http.ResponseWriter, r *http.Request
 	// Use pointers so that we can use their zero values of nil as part of the partial record
 	// update logic.
 	var input struct {
-		Name        *string `json:"name"`
-		Destination *string `json:"destination"`
-		Token       *string `json:"token"`
+		Name        *string    `json:"name"`
+		Destination *string    `json:"destination"`
+		Token       *string    `json:"token"`
+		DomainID    *uuid.UUID `json:"domain_id"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -170,6 +214,15 @@ func (app *application) updateLinkHandler(w http.ResponseWriter, r *http.Request
 		link.Token = *input.Token
 	}
 
+	// A link is moved back to the default domain with a nil UUID, as a null domain_id can't be
+	// told apart from a missing one.
+	if input.DomainID != nil {
+		link.DomainID = input.DomainID
+		if *input.DomainID == uuid.Nil {
+			link.DomainID = nil
+		}
+	}
+
 	v := validator.New()
 
 	if data.ValidateLink(v, link); !v.Valid() {
@@ -177,11 +230,18 @@ func (app *application) updateLinkHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !app.checkLinkDomain(w, r, link) {
+		return
+	}
+
 	err = app.models.Links.Update(link)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateToken):
+			v.AddError("token", "a link with this token already exists on this domain")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 
@@ -218,3 +278,47 @@ func (app *application) deleteLinkHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readLink reads the link identified by the id URL parameter, responding with the appropriate
+// error and returning nil if it doesn't exist.
+func (app *application) readLink(w http.ResponseWriter, r *http.Request) *data.Link {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	link, err := app.models.Links.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return link
+}
+
+// checkLinkDomain checks that the custom domain of a link exists, responding with a validation
+// error and returning false if it doesn't.
+func (app *application) checkLinkDomain(w http.ResponseWriter, r *http.Request, link *data.Link) bool {
+	if link.DomainID == nil {
+		return true
+	}
+
+	_, err := app.models.Domains.Get(*link.DomainID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"domain_id": "must be an existing domain"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/matthewsaunders/link-shortener-api/internal/stream"
+)
+
+const (
+	// liveCounterInterval is how often subscribed counters are pushed to live clients.
+	liveCounterInterval = 5 * time.Second
+
+	// liveMaxSubscriptions is the number of links a live client can subscribe to at once.
+	liveMaxSubscriptions = 100
+
+	// livePingInterval is how often live clients are pinged, and livePongWait how long they have
+	// to answer before being disconnected.
+	livePingInterval = 30 * time.Second
+	livePongWait     = 60 * time.Second
+)
+
+// liveMessage is a message sent by a live client.
+type liveMessage struct {
+	Type    string   `json:"type"`
+	LinkIDs []string `json:"link_ids"`
+}
+
+// liveSubscriptions is the set of links a live client is subscribed to.
+type liveSubscriptions struct {
+	mu    sync.Mutex
+	links map[uuid.UUID]struct{}
+}
+
+func (s *liveSubscriptions) list() []uuid.UUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]uuid.UUID, 0, len(s.links))
+	for id := range s.links {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// liveCountersHandler serves a WebSocket which pushes the live visit counters of the links the
+// client subscribes to. Clients send
+//
+//	{"type": "subscribe", "link_ids": ["<link id>", ...]}
+//	{"type": "unsubscribe", "link_ids": ["<link id>", ...]}
+//
+// and are sent {"type": "counters", "counters": [...]} every few seconds, as well as straight
+// after each change to their subscriptions. Invalid messages are answered with
+// {"type": "error", "error": "..."}.
+func (app *application) liveCountersHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: app.checkWebSocketOrigin}
+
+	// The upgrader responds with an error itself if the upgrade fails.
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	subs := &liveSubscriptions{links: map[uuid.UUID]struct{}{}}
+
+	// Links are only counted while subscribed to, so stop counting this client's links once it
+	// has gone.
+	defer func() {
+		for _, id := range subs.list() {
+			app.counters.Unwatch(id)
+		}
+	}()
+
+	// Writes are made from both the read loop and the push loop, so must be serialised.
+	var writeMu sync.Mutex
+	write := func(msg envelope) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(msg)
+	}
+
+	push := func() error {
+		now := time.Now()
+		counters := []stream.Counter{}
+		for _, id := range subs.list() {
+			counters = append(counters, app.counters.Get(id, now))
+		}
+		return write(envelope{"type": "counters", "counters": counters})
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(livePongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+
+	closed := make(chan struct{})
+
+	go func() {
+		defer close(closed)
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var msg liveMessage
+			if err := json.Unmarshal(message, &msg); err != nil {
+				if write(envelope{"type": "error", "error": "message contains badly-formed JSON"}) != nil {
+					return
+				}
+				continue
+			}
+
+			if problem := app.applyLiveMessage(subs, msg); problem != "" {
+				if write(envelope{"type": "error", "error": problem}) != nil {
+					return
+				}
+				continue
+			}
+
+			if push() != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(liveCounterInterval)
+	defer ticker.Stop()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-app.done:
+			writeMu.Lock()
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			writeMu.Unlock()
+			return
+		case <-ping.C:
+			writeMu.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			if push() != nil {
+				return
+			}
+		}
+	}
+}
+
+// applyLiveMessage applies a subscribe or unsubscribe message to a client's subscriptions,
+// returning a description of the problem if the message is invalid.
+func (app *application) applyLiveMessage(subs *liveSubscriptions, msg liveMessage) string {
+	ids := make([]uuid.UUID, 0, len(msg.LinkIDs))
+	for _, raw := range msg.LinkIDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return "link_ids must only contain valid link IDs"
+		}
+		ids = append(ids, id)
+	}
+
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	switch msg.Type {
+	case "subscribe":
+		added := 0
+		for _, id := range ids {
+			if _, ok := subs.links[id]; !ok {
+				added++
+			}
+		}
+
+		if len(subs.links)+added > liveMaxSubscriptions {
+			return fmt.Sprintf("must not subscribe to more than %d links", liveMaxSubscriptions)
+		}
+
+		for _, id := range ids {
+			if _, ok := subs.links[id]; !ok {
+				subs.links[id] = struct{}{}
+				app.counters.Watch(id)
+			}
+		}
+	case "unsubscribe":
+		for _, id := range ids {
+			if _, ok := subs.links[id]; ok {
+				delete(subs.links, id)
+				app.counters.Unwatch(id)
+			}
+		}
+	default:
+		return "type must be subscribe or unsubscribe"
+	}
+
+	return ""
+}
+
+// checkWebSocketOrigin allows WebSocket connections from the same origin, from the origins
+// trusted for CORS, and from non-browser clients which don't send an Origin header.
+func (app *application) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, trusted := range app.config.cors.trustedOrigins {
+		if origin == trusted {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// openAPISpec is the OpenAPI 3 document describing every route of the API. It is written against
+// the default redirect prefix and server, which showOpenAPIHandler swaps for the configured ones.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIRedirectPath is the path of the short link redirect in openAPISpec.
+const openAPIRedirectPath = "/a/{token}"
+
+func (app *application) showOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var spec envelope
+
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	spec["servers"] = []map[string]string{{"url": app.config.shortLinks.baseURL}}
+
+	// Short links are served under the configured prefix, or from the root.
+	if paths, ok := spec["paths"].(map[string]interface{}); ok {
+		prefix := strings.TrimSuffix(app.config.shortLinks.redirectPrefix, "/")
+		if redirect, ok := paths[openAPIRedirectPath]; ok {
+			delete(paths, openAPIRedirectPath)
+			paths[prefix+"/{token}"] = redirect
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, spec, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
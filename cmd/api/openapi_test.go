@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// pathParam matches the httprouter parameters of a route, e.g. :id.
+var pathParam = regexp.MustCompile(`:([a-z_]+)`)
+
+// routeRecorder is a router which records the "METHOD /path" of every route registered with it,
+// with the path's parameters written the OpenAPI way.
+type routeRecorder struct {
+	*httprouter.Router
+	routes []string
+}
+
+func (rec *routeRecorder) Handle(method, path string, handle httprouter.Handle) {
+	rec.record(method, path)
+	rec.Router.Handle(method, path, handle)
+}
+
+func (rec *routeRecorder) Handler(method, path string, handler http.Handler) {
+	rec.record(method, path)
+	rec.Router.Handler(method, path, handler)
+}
+
+func (rec *routeRecorder) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rec.record(method, path)
+	rec.Router.HandlerFunc(method, path, handler)
+}
+
+func (rec *routeRecorder) record(method, path string) {
+	rec.routes = append(rec.routes, method+" "+pathParam.ReplaceAllString(path, "{$1}"))
+}
+
+// registeredRoutes returns the "METHOD /path" of every route the API registers. The short link
+// redirect is registered under the default prefix, which the spec documents.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+
+	app := &application{}
+	app.config.shortLinks.redirectPrefix = "/a"
+
+	rec := &routeRecorder{Router: httprouter.New()}
+	app.registerRoutes(rec)
+
+	if len(rec.routes) == 0 {
+		t.Fatal("no routes registered")
+	}
+
+	return rec.routes
+}
+
+// documentedRoutes returns the "METHOD /path" of every operation in the OpenAPI spec.
+func documentedRoutes(t *testing.T) []string {
+	t.Helper()
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var routes []string
+
+	for path, item := range spec.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				routes = append(routes, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	return routes
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	registered := registeredRoutes(t)
+	documented := documentedRoutes(t)
+
+	inSpec := make(map[string]bool, len(documented))
+	for _, route := range documented {
+		inSpec[route] = true
+	}
+
+	inRoutes := make(map[string]bool, len(registered))
+	for _, route := range registered {
+		inRoutes[route] = true
+		if !inSpec[route] {
+			t.Errorf("%s is not documented in openapi.json", route)
+		}
+	}
+
+	sort.Strings(documented)
+	for _, route := range documented {
+		if !inRoutes[route] {
+			t.Errorf("%s is documented in openapi.json but not registered", route)
+		}
+	}
+}
+
+func TestOpenAPIRefsResolve(t *testing.T) {
+	var spec map[string]interface{}
+
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := node["$ref"].(string); ok {
+				if !resolves(spec, ref) {
+					t.Errorf("%s does not resolve", ref)
+				}
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+
+	walk(spec)
+}
+
+// resolves reports whether a local $ref such as #/components/schemas/Link points at something in
+// the spec.
+func resolves(spec map[string]interface{}, ref string) bool {
+	if !strings.HasPrefix(ref, "#/") {
+		return false
+	}
+
+	var node interface{} = spec
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if node, ok = object[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
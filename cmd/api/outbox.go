@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/outbox"
+)
+
+const (
+	// outboxBatchSize is the maximum number of events read on each pass of the relay.
+	outboxBatchSize = 100
+
+	// outboxPublishTimeout is how long a sink has to publish an event.
+	outboxPublishTimeout = 10 * time.Second
+)
+
+// webhookSubscriptionsSink is the name the webhook subscriptions are recorded under as a sink.
+const webhookSubscriptionsSink = "webhooks"
+
+// namedSink is an outbox sink, along with the name the events it has published are recorded
+// under. Configured sinks are named by their -outbox-sink spec.
+type namedSink struct {
+	name string
+	outbox.Sink
+}
+
+// relayOutbox publishes the events recorded in the outbox to every sink. Each sink is sent an
+// event until it has published it, independently of the others.
+func (app *application) relayOutbox() error {
+	names := make([]string, len(app.sinks))
+	sinks := make(map[string]outbox.Sink, len(app.sinks))
+	for i, sink := range app.sinks {
+		names[i] = sink.name
+		sinks[sink.name] = sink.Sink
+	}
+
+	publish := func(event outbox.Event, name string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxPublishTimeout)
+		defer cancel()
+
+		return sinks[name].Publish(ctx, event)
+	}
+
+	for {
+		published, err := app.models.Outbox.Relay(outboxBatchSize, names, publish)
+		if err != nil {
+			return err
+		}
+
+		// Stop once the outbox is drained, or the server starts shutting down. Anything left is
+		// picked up on the next run.
+		if published < outboxBatchSize {
+			return nil
+		}
+
+		select {
+		case <-app.done:
+			return nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"net/http"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/qr"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+// qrSource is the source recorded against visits made by scanning a link's QR code.
+const qrSource = "qr"
+
+func (app *application) showLinkQRHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	var input struct {
+		Format string
+		qr.Options
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Format = app.readStrings(qs, "format", "png")
+	input.Size = app.readInt(qs, "size", 256, v)
+	input.Margin = app.readInt(qs, "margin", 4, v)
+	input.Level = app.readStrings(qs, "ec", "M")
+	input.Foreground = app.readColor(qs, "fg", color.RGBA{A: 0xff}, v)
+	input.Background = app.readColor(qs, "bg", color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, v)
+
+	v.Check(validator.In(input.Format, "png", "svg"), "format", "must be png or svg")
+	v.Check(input.Size >= 64, "size", "must be at least 64")
+	v.Check(input.Size <= 2048, "size", "must be a maximum of 2048")
+	v.Check(input.Margin >= 0, "margin", "must not be negative")
+	v.Check(input.Margin <= 16, "margin", "must be a maximum of 16")
+	v.Check(validator.In(input.Level, qr.Levels...), "ec", "must be one of L, M, Q or H")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Mark the URL so that scans can be told apart from other visits.
+	content := link.ShortURL + "?source=" + qrSource
+
+	var body []byte
+	var err error
+
+	switch input.Format {
+	case "svg":
+		body, err = qr.SVG(content, input.Options)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		body, err = qr.PNG(content, input.Options)
+		w.Header().Set("Content-Type", "image/png")
+	}
+
+	if err != nil {
+		w.Header().Del("Content-Type")
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", link.Token+"."+input.Format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -6,12 +6,45 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
+// routeRegistry is what the API's routes are registered with. It is satisfied by
+// *httprouter.Router, and by recorders listing the routes in tests.
+type routeRegistry interface {
+	Handle(method, path string, handle httprouter.Handle)
+	Handler(method, path string, handler http.Handler)
+	HandlerFunc(method, path string, handler http.HandlerFunc)
+}
+
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
 
+	// Respond to unmatched requests with the API's own errors rather than httprouter's plain text.
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	// Short links served from the root can't be routed alongside the API's own paths, so they're
+	// served by whatever the router doesn't match.
+	if app.config.shortLinks.redirectPrefix == "/" {
+		router.NotFound = http.HandlerFunc(app.rootRedirectHandler)
+	}
+
+	app.registerRoutes(router)
+
+	return app.logRequests(app.recoverPanic(app.enableCORS(router)))
+}
+
+// registerRoutes registers every route of the API with router.
+func (app *application) registerRoutes(router routeRegistry) {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.showOpenAPIHandler)
 
-	router.HandlerFunc(http.MethodGet, "/a/:token", app.createVisitHandler)
+	// Short links
+	if app.config.shortLinks.redirectPrefix != "/" {
+		router.HandlerFunc(http.MethodGet, app.config.shortLinks.redirectPrefix+"/:token", app.createVisitHandler)
+	}
+
+	// Conversion tracking
+	router.HandlerFunc(http.MethodGet, "/c/pixel.gif", app.conversionPixelHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/conversions", app.createConversionHandler)
 
 	// Link CRUD
 	router.HandlerFunc(http.MethodGet, "/v1/links", app.listLinksHandler)
@@ -19,9 +52,46 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/links/:id", app.showLinkHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/links/:id", app.updateLinkHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/links/:id", app.deleteLinkHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/qr", app.showLinkQRHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/links/:id/visits", app.listLinkVisitsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/visits/raw", app.listLinkRawVisitsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/visits/breakdown", app.listLinkVisitBreakdownHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/visits/referrers", app.listLinkReferrersHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/visits/stream", app.streamLinkVisitsHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/tokens/new", app.getNewLinkToken)
+	// Live visits across every link
+	router.HandlerFunc(http.MethodGet, "/v1/visits/stream", app.streamVisitsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/visits/live", app.liveCountersHandler)
 
-	return app.logRequests(app.recoverPanic(app.enableCORS(router)))
+	// Link redirect rules
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/rules", app.listLinkRulesHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/links/:id/rules", app.createLinkRuleHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/rules/:rule_id", app.showLinkRuleHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/links/:id/rules/:rule_id", app.updateLinkRuleHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/links/:id/rules/:rule_id", app.deleteLinkRuleHandler)
+
+	// Link split destinations
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/destinations", app.listLinkDestinationsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/links/:id/destinations", app.createLinkDestinationHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/links/:id/destinations/:destination_id", app.showLinkDestinationHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/links/:id/destinations/:destination_id", app.updateLinkDestinationHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/links/:id/destinations/:destination_id", app.deleteLinkDestinationHandler)
+
+	// Custom domains
+	router.HandlerFunc(http.MethodGet, "/v1/domains", app.listDomainsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/domains", app.createDomainHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/domains/:id", app.showDomainHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/domains/:id", app.updateDomainHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/domains/:id", app.deleteDomainHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/domains/:id/verify", app.verifyDomainHandler)
+
+	// Webhooks
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.listWebhooksHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.createWebhookHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.showWebhookHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.updateWebhookHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.deleteWebhookHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.listWebhookDeliveriesHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/new", app.getNewLinkToken)
 }
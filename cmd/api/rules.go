@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+// optionalTime is a time in a partial update which can be cleared. It tells an explicit null,
+// which clears the field, apart from a missing field, which leaves it as is.
+type optionalTime struct {
+	Set  bool
+	Time *time.Time
+}
+
+func (t *optionalTime) UnmarshalJSON(b []byte) error {
+	t.Set = true
+
+	if bytes.Equal(b, []byte("null")) {
+		t.Time = nil
+		return nil
+	}
+
+	return json.Unmarshal(b, &t.Time)
+}
+
+// readRule reads the rule a request is made against, responding with the appropriate error and
+// returning nil if it doesn't exist.
+func (app *application) readRule(w http.ResponseWriter, r *http.Request) *data.LinkRule {
+	link := app.readLink(w, r)
+	if link == nil {
+		return nil
+	}
+
+	ruleID, err := app.readUUIDParam(r, "rule_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	rule, err := app.models.Rules.Get(link.ID, ruleID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return rule
+}
+
+func (app *application) listLinkRulesHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	rules, err := app.models.Rules.GetAllForLink(link.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"rules": rules}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createLinkRuleHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	// Rules created without a position are placed after the link's existing rules.
+	var input struct {
+		Position         *int       `json:"position"`
+		Destination      string     `json:"destination"`
+		Countries        []string   `json:"countries"`
+		Devices          []string   `json:"devices"`
+		OperatingSystems []string   `json:"operating_systems"`
+		Languages        []string   `json:"languages"`
+		StartsAt         *time.Time `json:"starts_at"`
+		EndsAt           *time.Time `json:"ends_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	rule := &data.LinkRule{
+		LinkID:           link.ID,
+		Destination:      input.Destination,
+		Countries:        input.Countries,
+		Devices:          input.Devices,
+		OperatingSystems: input.OperatingSystems,
+		Languages:        input.Languages,
+		StartsAt:         input.StartsAt,
+		EndsAt:           input.EndsAt,
+	}
+
+	if input.Position != nil {
+		rule.Position = *input.Position
+	}
+
+	v := validator.New()
+
+	if data.ValidateLinkRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Rules.Insert(rule, input.Position == nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/links/%s/rules/%s", link.ID, rule.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"rule": rule}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showLinkRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule := app.readRule(w, r)
+	if rule == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"rule": rule}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateLinkRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule := app.readRule(w, r)
+	if rule == nil {
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(rule.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	// Use pointers so that we can use their zero values of nil as part of the partial record
+	// update logic. The times can be cleared with null, so they tell null apart from left out.
+	var input struct {
+		Position         *int         `json:"position"`
+		Destination      *string      `json:"destination"`
+		Countries        []string     `json:"countries"`
+		Devices          []string     `json:"devices"`
+		OperatingSystems []string     `json:"operating_systems"`
+		Languages        []string     `json:"languages"`
+		StartsAt         optionalTime `json:"starts_at"`
+		EndsAt           optionalTime `json:"ends_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Update fields if new value was given. An empty list clears a condition, while a missing one
+	// leaves it as is.
+	if input.Position != nil {
+		rule.Position = *input.Position
+	}
+
+	if input.Destination != nil {
+		rule.Destination = *input.Destination
+	}
+
+	if input.Countries != nil {
+		rule.Countries = input.Countries
+	}
+
+	if input.Devices != nil {
+		rule.Devices = input.Devices
+	}
+
+	if input.OperatingSystems != nil {
+		rule.OperatingSystems = input.OperatingSystems
+	}
+
+	if input.Languages != nil {
+		rule.Languages = input.Languages
+	}
+
+	if input.StartsAt.Set {
+		rule.StartsAt = input.StartsAt.Time
+	}
+
+	if input.EndsAt.Set {
+		rule.EndsAt = input.EndsAt.Time
+	}
+
+	v := validator.New()
+
+	if data.ValidateLinkRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Rules.Update(rule)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"rule": rule}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteLinkRuleHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	ruleID, err := app.readUUIDParam(r, "rule_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Rules.Delete(link.ID, ruleID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "rule successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -22,6 +26,46 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Shutdown waits for active requests to finish, so end any open streams when it starts.
+	srv.RegisterOnShutdown(app.stream.Close)
+
+	// Certificates are picked per handshake, so rotated and newly added ones are served as soon
+	// as they are reloaded. Listing h2 serves HTTP/2 to the clients which support it.
+	if app.certs != nil {
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: app.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+
+	var redirectSrv *http.Server
+	if app.config.tls.redirectPort != 0 {
+		redirectSrv = &http.Server{
+			Addr:         fmt.Sprintf(":%d", app.config.tls.redirectPort),
+			Handler:      http.HandlerFunc(app.redirectToHTTPS),
+			ErrorLog:     log.New(app.logger, "", 0),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+
+		// Listen before starting the main server, so a port which is in use fails startup.
+		ln, err := net.Listen("tcp", redirectSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			app.logger.Info().Str("addr", redirectSrv.Addr).Msg("starting HTTPS redirect server")
+
+			err := redirectSrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error().Err(err).Str("addr", redirectSrv.Addr).Msg("HTTPS redirect server failed")
+			}
+		}()
+	}
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -35,6 +79,12 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if redirectSrv != nil {
+			if err := redirectSrv.Shutdown(ctx); err != nil {
+				app.logger.Error().Err(err).Str("addr", redirectSrv.Addr).Msg("")
+			}
+		}
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
@@ -42,13 +92,23 @@ func (app *application) serve() error {
 
 		app.logger.Info().Str("addr", srv.Addr).Msg("completing background tasks")
 
+		// Signal any periodic jobs to stop before waiting on the background goroutines.
+		close(app.done)
+
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
 
+	app.startJobs()
+
 	app.logger.Info().Str("addr", srv.Addr).Str("env", app.config.env).Msg("starting server")
 
-	err := srv.ListenAndServe()
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -58,3 +118,19 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// redirectToHTTPS permanently redirects plain HTTP requests to the same URL on the HTTPS server.
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+
+	if app.config.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(app.config.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
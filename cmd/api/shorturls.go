@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+)
+
+// reservedPrefixes are the first path segments used by the API's own routes, which the redirect
+// prefix must not clash with.
+var reservedPrefixes = []string{"v1", "c"}
+
+// checkShortURLConfig validates and normalises the base URL and redirect prefix.
+func checkShortURLConfig(cfg *config) error {
+	u, err := url.Parse(cfg.shortLinks.baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("base URL %q must be an absolute http or https URL", cfg.shortLinks.baseURL)
+	}
+
+	prefix := "/" + strings.Trim(cfg.shortLinks.redirectPrefix, "/")
+
+	first, _, _ := strings.Cut(strings.TrimPrefix(prefix, "/"), "/")
+	for _, reserved := range reservedPrefixes {
+		if first == reserved {
+			return fmt.Errorf("redirect prefix %q clashes with the /%s routes", cfg.shortLinks.redirectPrefix, reserved)
+		}
+	}
+
+	if strings.ContainsAny(prefix, ":*") {
+		return errors.New("redirect prefix must not contain route parameters")
+	}
+
+	cfg.shortLinks.baseURL = strings.TrimSuffix(cfg.shortLinks.baseURL, "/")
+	cfg.shortLinks.hostname = strings.ToLower(u.Hostname())
+	cfg.shortLinks.redirectPrefix = prefix
+
+	return nil
+}
+
+// readDomain returns the custom domain a request was made to, or nil if it was made to the
+// default domain. Requests to unknown hosts, e.g. the server's IP address, and to domains which
+// haven't been verified are treated as being made to the default domain.
+func (app *application) readDomain(r *http.Request) (*data.Domain, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if host == "" || host == app.config.shortLinks.hostname {
+		return nil, nil
+	}
+
+	domain, err := app.models.Domains.GetByHostname(host)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	if domain.Status != data.DomainVerified {
+		return nil, nil
+	}
+
+	return domain, nil
+}
+
+// rootRedirectHandler serves short links from the root of the server. The router can't mix a
+// root level parameter with the API's routes, so it is served as the router's not found handler
+// instead, redirecting any single segment path and responding 404 to everything else.
+func (app *application) rootRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/")
+
+	if r.Method != http.MethodGet || token == "" || strings.Contains(token, "/") {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	params := httprouter.Params{{Key: "token", Value: token}}
+	ctx := context.WithValue(r.Context(), httprouter.ParamsKey, params)
+
+	app.createVisitHandler(w, r.WithContext(ctx))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/stream"
+)
+
+const (
+	// streamHistorySize is the number of recent events kept for clients resuming a stream.
+	streamHistorySize = 1000
+
+	// streamHeartbeatInterval is how often a heartbeat event is sent to keep idle streams open
+	// through proxies.
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+func (app *application) streamLinkVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	app.streamEvents(w, r, link.ID)
+}
+
+func (app *application) streamVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	app.streamEvents(w, r, uuid.Nil)
+}
+
+// streamEvents streams the events of a link, or of every link if linkID is uuid.Nil, as
+// Server-Sent Events until the client disconnects or the server shuts down. Clients reconnecting
+// with a Last-Event-ID header are first sent the events they missed, as far as they are still in
+// the hub's history.
+func (app *application) streamEvents(w http.ResponseWriter, r *http.Request, linkID uuid.UUID) {
+	var lastEventID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("invalid Last-Event-ID header"))
+			return
+		}
+		lastEventID = id
+	}
+
+	// Streams outlive the server's write timeout, so lift it for this response.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sub, missed := app.stream.Subscribe(linkID, lastEventID)
+	defer app.stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		if err := writeStreamEvent(w, event); err != nil {
+			return
+		}
+	}
+
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+		case t := <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, "event: heartbeat\ndata: {\"time\":%q}\n\n", t.UTC().Format(time.RFC3339)); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes an event in the Server-Sent Events format. Event data is JSON, which
+// never contains a raw newline, so it fits on a single data line.
+func writeStreamEvent(w http.ResponseWriter, event stream.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
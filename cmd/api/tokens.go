@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/matthewsaunders/link-shortener-api/internal/data"
 )
 
@@ -11,12 +12,23 @@ func (app *application) getNewLinkToken(w http.ResponseWriter, r *http.Request)
 	uniqueToken := false
 	var token string
 
+	// Tokens only need to be unique on the domain the link is created on.
+	var domainID *uuid.UUID
+	if s := r.URL.Query().Get("domain_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			app.failedValidationResponse(w, r, map[string]string{"domain_id": "must be a valid ID"})
+			return
+		}
+		domainID = &id
+	}
+
 	for {
 		// generate new token
 		token = app.models.Links.GenerateNewToken()
 
 		// check token is unique
-		_, err := app.models.Links.GetByToken(token)
+		_, err := app.models.Links.GetByToken(domainID, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
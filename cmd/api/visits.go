@@ -1,10 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"hash/fnv"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/bots"
 	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/referrer"
+	"github.com/matthewsaunders/link-shortener-api/internal/useragent"
 	"github.com/matthewsaunders/link-shortener-api/internal/validator"
 )
 
@@ -15,9 +23,23 @@ func (app *application) createVisitHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	link, err := app.models.Links.GetByToken(token)
+	domain, err := app.readDomain(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var domainID *uuid.UUID
+	if domain != nil {
+		domainID = &domain.ID
+	}
+
+	redirect, err := app.models.Links.GetRedirect(domainID, token)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && domain != nil && domain.FallbackURL != "":
+			// Custom domains send visitors of unknown tokens to their fallback URL.
+			http.Redirect(w, r, domain.FallbackURL, http.StatusFound)
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
 		default:
@@ -26,10 +48,81 @@ func (app *application) createVisitHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	link := redirect.Link
+
+	remoteAddr := app.readRemoteIP(r)
+	userAgent := r.UserAgent()
+	parsedUserAgent := useragent.Parse(userAgent)
+
+	visitorHash, err := app.models.Visits.VisitorHash(remoteAddr, userAgent)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// A failed lookup shouldn't stop the visitor from being redirected, so just log it.
+	location, err := app.geoip.Lookup(remoteAddr)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	// Send the visitor to the destination of the first matching rule, falling back to the link's.
+	destination := link.Destination
+	status := http.StatusMovedPermanently
+
+	rule := data.MatchRule(redirect.Rules, data.RuleContext{
+		Country:   location.Country,
+		Device:    parsedUserAgent.Device,
+		OS:        parsedUserAgent.OS,
+		Languages: app.readAcceptLanguages(r),
+		Time:      time.Now(),
+	})
+
+	if rule != nil {
+		destination = rule.Destination
+	}
+
+	// Links split across several destinations rotate visitors between them, unless a rule has
+	// already picked the destination.
+	var variant *data.LinkDestination
+	if rule == nil {
+		variant = app.chooseVariant(w, r, link, redirect.Destinations, remoteAddr)
+	}
+
+	if variant != nil {
+		destination = variant.Destination
+	}
+
+	// The destination of a link with rules or split destinations depends on the visitor, so
+	// browsers mustn't cache the redirect.
+	if len(redirect.Rules) > 0 || len(redirect.Destinations) > 0 {
+		status = http.StatusFound
+	}
+
 	visit := &data.Visit{
-		LinkID:     link.ID,
-		Referrer:   "",
-		RemoteAddr: "",
+		LinkID:         link.ID,
+		Referrer:       r.Referer(),
+		ReferrerHost:   referrer.Host(r.Referer()),
+		RemoteAddr:     remoteAddr,
+		UserAgent:      userAgent,
+		Browser:        parsedUserAgent.Browser,
+		BrowserVersion: parsedUserAgent.BrowserVersion,
+		OS:             parsedUserAgent.OS,
+		Device:         parsedUserAgent.Device,
+		Country:        location.Country,
+		Region:         location.Region,
+		City:           location.City,
+		Source:         app.readSource(r),
+		IsBot:          bots.IsBot(userAgent, r.Header),
+		VisitorHash:    visitorHash,
+	}
+
+	if rule != nil {
+		visit.RuleID = &rule.ID
+	}
+
+	if variant != nil {
+		visit.VariantID = &variant.ID
 	}
 
 	v := validator.New()
@@ -45,8 +138,131 @@ func (app *application) createVisitHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	w.Header().Set("Location", link.Destination)
-	w.WriteHeader(http.StatusMovedPermanently)
+	// Publish the visit to anyone watching the link live, with its IP address masked as in the
+	// visit listings. A visit which fails to encode is only missing from the stream, so just log it.
+	if event, err := json.Marshal(visit.Masked(app.config.visits.ipPrivacy)); err != nil {
+		app.logError(r, err)
+	} else {
+		app.stream.Publish(link.ID, "visit", event)
+	}
+
+	if !visit.IsBot {
+		app.counters.Add(link.ID, visit.CreatedAt)
+	}
+
+	destination = app.trackClick(w, r, visit, destination)
+
+	// A destination carrying the click ID is unique to this visit, so it mustn't be cached.
+	if app.config.conversions.clickIDParam != "" {
+		status = http.StatusFound
+	}
+
+	w.Header().Set("Location", destination)
+	w.WriteHeader(status)
+}
+
+// variantCookieName is the name of the cookie holding the split destinations visitors have been
+// assigned, as link and destination ID pairs.
+const variantCookieName = "shrtnr_variants"
+
+// maxVariantAssignments is the number of links whose assigned destination the variant cookie
+// remembers. The most recently visited links are kept, which keeps the cookie well under the
+// size browsers accept.
+const maxVariantAssignments = 20
+
+// chooseVariant picks which of a link's split destinations to send a visitor to. Visitors stick
+// to the destination they were first assigned by a cookie, and visitors without the cookie are
+// assigned by a hash of their IP address, which keeps them on the same destination even if they
+// don't accept cookies.
+func (app *application) chooseVariant(w http.ResponseWriter, r *http.Request, link *data.Link, destinations []*data.LinkDestination, remoteAddr string) *data.LinkDestination {
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	assignments := readVariantAssignments(r)
+
+	var variant *data.LinkDestination
+
+	for _, assignment := range assignments {
+		if assignment[0] == link.ID {
+			variant = data.FindDestination(destinations, assignment[1])
+			break
+		}
+	}
+
+	if variant == nil {
+		hash := fnv.New64a()
+		hash.Write([]byte(link.ID.String()))
+		hash.Write([]byte(remoteAddr))
+
+		variant = data.ChooseDestination(destinations, hash.Sum64())
+		if variant == nil {
+			return nil
+		}
+	}
+
+	// Move the link to the front, so the links dropped once the cookie is full are the ones
+	// visited longest ago.
+	values := []string{link.ID.String() + ":" + variant.ID.String()}
+
+	for _, assignment := range assignments {
+		if assignment[0] != link.ID && len(values) < maxVariantAssignments {
+			values = append(values, assignment[0].String()+":"+assignment[1].String())
+		}
+	}
+
+	// The cookie is only needed by redirects, so keep it off every other request.
+	path := strings.TrimSuffix(app.config.shortLinks.redirectPrefix, "/")
+	if path == "" {
+		path = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookieName,
+		Value:    strings.Join(values, "."),
+		Path:     path,
+		MaxAge:   int((90 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return variant
+}
+
+// readVariantAssignments returns the link and destination ID pairs held by the variant cookie,
+// most recently visited first. Malformed pairs are ignored.
+func readVariantAssignments(r *http.Request) [][2]uuid.UUID {
+	cookie, err := r.Cookie(variantCookieName)
+	if err != nil {
+		return nil
+	}
+
+	assignments := [][2]uuid.UUID{}
+
+	for _, pair := range strings.Split(cookie.Value, ".") {
+		linkID, variantID, ok := strings.Cut(pair, ":")
+		if !ok {
+			continue
+		}
+
+		var assignment [2]uuid.UUID
+
+		if assignment[0], err = uuid.Parse(linkID); err != nil {
+			continue
+		}
+
+		if assignment[1], err = uuid.Parse(variantID); err != nil {
+			continue
+		}
+
+		assignments = append(assignments, assignment)
+
+		if len(assignments) == maxVariantAssignments {
+			break
+		}
+	}
+
+	return assignments
 }
 
 func (app *application) listLinkVisitsHandler(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +283,16 @@ func (app *application) listLinkVisitsHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	linkData, err := app.models.Visits.GetData(link)
+	v := validator.New()
+
+	includeBots := app.readBool(r.URL.Query(), "include_bots", false, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	linkData, err := app.models.Visits.GetData(link, includeBots)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -79,3 +304,179 @@ func (app *application) listLinkVisitsHandler(w http.ResponseWriter, r *http.Req
 	}
 
 }
+
+func (app *application) listLinkVisitBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		By          string
+		From        time.Time
+		To          time.Time
+		IncludeBots bool
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	input.By = app.readStrings(qs, "by", "")
+	input.To = app.readDate(qs, "to", today, v)
+	input.From = app.readDate(qs, "from", input.To.AddDate(0, 0, -29), v)
+	input.IncludeBots = app.readBool(qs, "include_bots", false, v)
+
+	v.Check(input.By != "", "by", "must be provided")
+	v.Check(validator.In(input.By, data.BreakdownSafeList...), "by", "invalid breakdown value")
+
+	if data.ValidateDateRange(v, input.From, input.To); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	link, err := app.models.Links.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	breakdown, err := app.models.Visits.GetBreakdown(link, input.By, input.From, input.To, input.IncludeBots)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"by":        input.By,
+		"from":      input.From.Format("2006-01-02"),
+		"to":        input.To.Format("2006-01-02"),
+		"breakdown": breakdown,
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listLinkReferrersHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		From        time.Time
+		To          time.Time
+		IncludeBots bool
+		Limit       int
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	input.To = app.readDate(qs, "to", today, v)
+	input.From = app.readDate(qs, "from", input.To.AddDate(0, 0, -29), v)
+	input.IncludeBots = app.readBool(qs, "include_bots", false, v)
+	input.Limit = app.readInt(qs, "limit", 10, v)
+
+	v.Check(input.Limit > 0, "limit", "must be greater than 0")
+	v.Check(input.Limit <= 100, "limit", "must be a maximum of 100")
+
+	if data.ValidateDateRange(v, input.From, input.To); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	link, err := app.models.Links.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	referrers, totalVisits, err := app.models.Visits.GetTopReferrers(link, input.From, input.To, input.IncludeBots, input.Limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"from":         input.From.Format("2006-01-02"),
+		"to":           input.To.Format("2006-01-02"),
+		"total_visits": totalVisits,
+		"referrers":    referrers,
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listLinkRawVisitsHandler lists the individual visits of a link, most recent first by default.
+func (app *application) listLinkRawVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	link := app.readLink(w, r)
+	if link == nil {
+		return
+	}
+
+	var input struct {
+		data.VisitFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.VisitFilter.From = app.readTime(qs, "from", false, v)
+	input.VisitFilter.To = app.readTime(qs, "to", true, v)
+	input.VisitFilter.Referrer = app.readStrings(qs, "referrer", "")
+	input.VisitFilter.Country = strings.ToUpper(app.readStrings(qs, "country", ""))
+	input.VisitFilter.Device = app.readStrings(qs, "device", "")
+
+	if qs.Get("is_bot") != "" {
+		isBot := app.readBool(qs, "is_bot", false, v)
+		input.VisitFilter.IsBot = &isBot
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "-created_at")
+	input.Filters.Cursor = app.readStrings(qs, "cursor", "")
+	input.Filters.CursorKey = app.cursorKey
+
+	input.Filters.SortSafeList = []string{"created_at", "-created_at"}
+
+	if !input.VisitFilter.From.IsZero() && !input.VisitFilter.To.IsZero() {
+		v.Check(input.VisitFilter.To.After(input.VisitFilter.From), "to", "must be after from")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	visits, metadata, err := app.models.Visits.GetAll(link.ID, input.VisitFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"visits": visits, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
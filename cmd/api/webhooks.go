@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/data"
+	"github.com/matthewsaunders/link-shortener-api/internal/outbox"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/matthewsaunders/link-shortener-api/internal/webhook"
+)
+
+const (
+	// webhookBatchSize is the maximum number of deliveries sent on each run of the worker.
+	webhookBatchSize = 50
+
+	// webhookLease is how long a claimed delivery is held by the worker sending it before it can
+	// be claimed again.
+	webhookLease = time.Minute
+
+	// webhookTimeout is how long a webhook receiver has to respond.
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookSubscriptions is the outbox sink which queues deliveries of each event to the webhooks
+// subscribed to it.
+type webhookSubscriptions struct {
+	models data.Models
+}
+
+func (s webhookSubscriptions) Publish(ctx context.Context, event outbox.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.models.Webhooks.Enqueue(event.ID, event.Type, body)
+}
+
+func (s webhookSubscriptions) Close() error {
+	return nil
+}
+
+// deliverWebhooks sends the deliveries which are due, recording the outcome of each. A delivery
+// which fails is retried with exponential backoff until it runs out of attempts.
+func (app *application) deliverWebhooks() error {
+	for {
+		deliveries, err := app.models.Webhooks.ClaimDeliveries(webhookBatchSize, webhookLease)
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+
+			status, sendErr := webhook.Send(ctx, app.webhookClient, webhook.Request{
+				URL:        delivery.URL,
+				Secret:     delivery.Secret,
+				Event:      delivery.Event,
+				DeliveryID: delivery.ID.String(),
+				Body:       delivery.Payload,
+			})
+
+			cancel()
+
+			err := app.models.Webhooks.RecordAttempt(delivery, status, sendErr, webhook.Backoff(delivery.Attempts+1))
+			if err != nil {
+				return err
+			}
+
+			if delivery.Status == data.DeliveryDead {
+				app.logger.Warn().Str("delivery", delivery.ID.String()).Str("webhook", delivery.WebhookID.String()).Err(sendErr).Msg("webhook delivery dead")
+			}
+		}
+
+		// Stop once the queue is drained, or the server starts shutting down. Anything left is
+		// picked up on the next run.
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+
+		select {
+		case <-app.done:
+			return nil
+		default:
+		}
+	}
+}
+
+// checkWebhookURL rejects webhook URLs whose host is, or resolves to, an address which isn't
+// public, unless -webhook-allow-private is set. Deliveries are checked again as they are sent.
+func (app *application) checkWebhookURL(v *validator.Validator, rawURL string) {
+	if app.config.webhooks.allowPrivate {
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = webhook.CheckHost(ctx, net.DefaultResolver, u.Hostname())
+	switch {
+	case errors.Is(err, webhook.ErrNonPublicAddress):
+		v.AddError("url", "must not be a loopback, private or otherwise non-public address")
+	case err != nil:
+		v.AddError("url", "host could not be resolved")
+	}
+}
+
+// readWebhook reads the webhook a request is made against, responding with the appropriate error
+// and returning nil if it doesn't exist.
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) *data.Webhook {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	hook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return hook
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "created_at")
+
+	input.Filters.SortSafeList = []string{"created_at", "url", "-created_at", "-url"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhooks, metadata, err := app.models.Webhooks.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	hook := &data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+		Active: true,
+	}
+
+	if input.Active != nil {
+		hook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, hook); v.Valid() {
+		app.checkWebhookURL(v, hook.URL)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hook.Secret, err = webhook.NewSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(hook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%s", hook.ID))
+
+	// The secret is only ever shown here, so it must be stored by the caller.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": hook, "secret": hook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook := app.readWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": hook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook := app.readWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(hook.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	// Use pointers so that we can use their zero values of nil as part of the partial record
+	// update logic.
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		hook.URL = *input.URL
+	}
+
+	if input.Events != nil {
+		hook.Events = input.Events
+	}
+
+	if input.Active != nil {
+		hook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, hook); v.Valid() {
+		app.checkWebhookURL(v, hook.URL)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(hook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": hook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook := app.readWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readStrings(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "-created_at")
+
+	input.Filters.SortSafeList = []string{"created_at", "next_attempt_at", "-created_at", "-next_attempt_at"}
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.DeliveryStatuses...), "status", "invalid status value")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(hook.ID, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
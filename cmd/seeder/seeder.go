@@ -107,7 +107,11 @@ func (s *seeder) seedLink2() error {
 }
 
 func (s *seeder) seedDB() error {
-	var err error
+	// The seeded visits are backdated, so they can only be inserted while nothing is rolled up.
+	err := s.models.Visits.ResetRollups()
+	if err != nil {
+		return err
+	}
 
 	err = s.seedLink1()
 	if err != nil {
@@ -119,5 +123,10 @@ func (s *seeder) seedDB() error {
 		return err
 	}
 
+	_, err = s.models.Visits.RollUp()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,66 @@
+// Package bots classifies requests made by bots and crawlers, such as the link preview fetchers
+// of chat apps and social networks, search engine crawlers, uptime checkers and HTTP libraries.
+package bots
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// crawlerToken matches a product token of a user agent naming a crawler, e.g. Googlebot/2.1 or
+// "compatible; YandexSpider;". The name has to end the token, so that words which merely contain
+// "bot" don't match, and be followed by a version, a separator or a comment, so that phone models
+// such as "CUBOT X30" don't either.
+var crawlerToken = regexp.MustCompile(`(?:^|[\s;(,+-])[a-z0-9._]*(?:bot|crawler|spider)(?:$|[/;),+-]| \()`)
+
+// userAgentMarkers are lower cased product tokens of user agents which identify a bot whose name
+// doesn't end with bot, crawler or spider. They are specific to the bot, as browsers and in-app
+// browsers pad their user agents with all sorts of words.
+var userAgentMarkers = []string{
+	// Link preview fetchers of chat apps and social networks.
+	"facebookexternalhit/", "facebookcatalog/", "skypeuripreview", "embedly", "quora link preview",
+	"vkshare", "w3c_validator", "iframely/", "kakaotalk-scrap/", "cardyb/", "yahoo! slurp",
+	// Uptime checkers and monitoring services.
+	"uptimerobot/", "pingdom.com_bot", "statuscake", "site24x7", "newrelicpinger/",
+	"datadogsynthetics", "betteruptime", "checkly/",
+	// Headless and automated browsers.
+	"headlesschrome/", "phantomjs/", "chrome-lighthouse",
+}
+
+// IsBot reports whether a request with the given user agent and headers was most likely made
+// by a bot rather than a person.
+func IsBot(userAgent string, header http.Header) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+
+	// Browsers always send a user agent.
+	if ua == "" {
+		return true
+	}
+
+	// Every browser claims to be Mozilla compatible, so clients which don't, such as curl and
+	// HTTP libraries, are scripts.
+	if !strings.HasPrefix(ua, "mozilla/") && !strings.HasPrefix(ua, "opera/") {
+		return true
+	}
+
+	if crawlerToken.MatchString(ua) {
+		return true
+	}
+
+	for _, marker := range userAgentMarkers {
+		if strings.Contains(ua, marker) {
+			return true
+		}
+	}
+
+	// Prefetches and previews are made on behalf of a person, but not by them.
+	for _, name := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		value := strings.ToLower(header.Get(name))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+// Package certs serves the TLS certificates of the API: a default certificate, and certificates
+// of custom domains selected by the name the client asks for. Certificates are reloaded when
+// their files change, so they can be rotated without restarting the server.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store holds the loaded certificates.
+type Store struct {
+	certFile string
+	keyFile  string
+	dir      string
+
+	mu       sync.RWMutex
+	def      *tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// Open loads the default certificate from certFile and keyFile, and the certificates in dir.
+// Either may be empty, but not both. Each certificate in dir is a <name>.crt file of PEM encoded
+// certificates with its key in <name>.key, and is served for the names it is valid for.
+func Open(certFile, keyFile, dir string) (*Store, error) {
+	if certFile == "" && dir == "" {
+		return nil, errors.New("no certificates configured")
+	}
+
+	s := &Store{certFile: certFile, keyFile: keyFile, dir: dir}
+
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload loads the certificates again if any of their files have been added, removed or
+// modified since they were last loaded. It reports whether the certificates were reloaded.
+// Handshakes keep using the previous certificates until the new ones have all loaded
+// successfully.
+func (s *Store) Reload() (bool, error) {
+	pairs, err := s.pairs()
+	if err != nil {
+		return false, err
+	}
+
+	modTimes := map[string]time.Time{}
+	for cert, key := range pairs {
+		for _, path := range []string{cert, key} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return false, err
+			}
+			modTimes[path] = info.ModTime()
+		}
+	}
+
+	s.mu.RLock()
+	unchanged := s.modTimes != nil && sameModTimes(s.modTimes, modTimes)
+	s.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	var def *tls.Certificate
+	byName := map[string]*tls.Certificate{}
+
+	for certFile, keyFile := range pairs {
+		cert, err := load(certFile, keyFile)
+		if err != nil {
+			return false, err
+		}
+
+		if certFile == s.certFile {
+			def = cert
+			continue
+		}
+
+		for _, name := range names(cert, certFile) {
+			byName[name] = cert
+		}
+	}
+
+	s.mu.Lock()
+	s.def = def
+	s.byName = byName
+	s.modTimes = modTimes
+	s.mu.Unlock()
+
+	return true, nil
+}
+
+// GetCertificate returns the certificate for the name a client asks for, falling back to the
+// default certificate. It is used as the tls.Config's GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	if s.def != nil {
+		return s.def, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// pairs returns the certificate files to load mapped to their key files.
+func (s *Store) pairs() (map[string]string, error) {
+	pairs := map[string]string{}
+
+	if s.certFile != "" {
+		pairs[s.certFile] = s.keyFile
+	}
+
+	if s.dir != "" {
+		matches, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cert := range matches {
+			pairs[cert] = strings.TrimSuffix(cert, ".crt") + ".key"
+		}
+	}
+
+	return pairs, nil
+}
+
+func load(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", certFile, err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", certFile, err)
+	}
+
+	return &cert, nil
+}
+
+// names returns the names a certificate is served for: the DNS names it is valid for, or the
+// name of its file if it has none.
+func names(cert *tls.Certificate, file string) []string {
+	var names []string
+	for _, name := range cert.Leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+
+	if len(names) == 0 {
+		names = append(names, strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".crt")))
+	}
+
+	return names
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for path, t := range a {
+		if u, ok := b[path]; !ok || !t.Equal(u) {
+			return false
+		}
+	}
+
+	return true
+}
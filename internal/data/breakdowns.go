@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+)
+
+// BreakdownSafeList holds the dimensions visits can be broken down by.
+var BreakdownSafeList = []string{"browser", "os", "device", "country", "region", "city", "source"}
+
+// breakdownColumns maps each dimension in BreakdownSafeList to the visits column it groups by.
+var breakdownColumns = map[string]string{
+	"browser": "browser",
+	"os":      "os",
+	"device":  "device",
+	"country": "country",
+	"region":  "region",
+	"city":    "city",
+	"source":  "source",
+}
+
+type VisitBreakdown struct {
+	Value  string `json:"value"`
+	Visits int    `json:"visits"`
+}
+
+// GetBreakdown counts the visits of a link between the from and to days (inclusive), grouped by
+// one of the dimensions in BreakdownSafeList. Visits by bots are only counted when includeBots is
+// true.
+func (m VisitModel) GetBreakdown(link *Link, by string, from, to time.Time, includeBots bool) ([]*VisitBreakdown, error) {
+	column, ok := breakdownColumns[by]
+	if !ok {
+		// The dimension should already have been checked against BreakdownSafeList. This is a
+		// failsafe against SQL injection, as the column is interpolated into the query.
+		panic("unsafe breakdown parameter: " + by)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT COALESCE(NULLIF(%s, ''), 'unknown') AS value, count(*)
+		FROM visits
+		WHERE visits.link_id = $1
+		AND (visits.is_bot = FALSE OR $2)
+		AND created_at >= CAST($3 as DATE)
+		AND created_at < CAST($4 as DATE) + 1
+		GROUP BY value
+		ORDER BY count(*) DESC, value ASC
+	`, column)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{link.ID, includeBots, from.Format(layoutISO), to.Format(layoutISO)}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	breakdown := []*VisitBreakdown{}
+
+	for rows.Next() {
+		var item VisitBreakdown
+
+		if err := rows.Scan(&item.Value, &item.Visits); err != nil {
+			return nil, err
+		}
+
+		breakdown = append(breakdown, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
+
+// ValidateDateRange checks that a from and to day make up a valid range.
+func ValidateDateRange(v *validator.Validator, from, to time.Time) {
+	v.Check(!to.Before(from), "to", "must not be before from")
+	v.Check(to.Sub(from) <= 366*24*time.Hour, "to", "must be within a year of from")
+}
@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/rs/zerolog"
+)
+
+// DefaultGoal is the goal recorded for conversions which don't name one.
+const DefaultGoal = "conversion"
+
+// Conversion records a visitor completing a goal (e.g. signing up) after clicking a link. It is
+// attributed to the visit whose click ID the visitor carried.
+type Conversion struct {
+	ID        uuid.UUID `json:"id"`
+	VisitID   uuid.UUID `json:"click_id"`
+	LinkID    uuid.UUID `json:"link_id"`
+	Goal      string    `json:"goal"`
+	Value     float64   `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GoalConversions struct {
+	Goal        string  `json:"goal"`
+	Conversions int     `json:"conversions"`
+	Value       float64 `json:"value"`
+}
+
+func ValidateConversion(v *validator.Validator, conversion *Conversion) {
+	v.Check(conversion.VisitID != uuid.Nil, "click_id", "must be provided")
+	v.Check(conversion.Goal != "", "goal", "must be provided")
+	v.Check(len(conversion.Goal) <= 100, "goal", "must not be more than 100 bytes long")
+	v.Check(conversion.Value >= 0, "value", "must not be negative")
+	v.Check(conversion.Value < 1_000_000_000_000, "value", "must be less than 1 trillion")
+}
+
+type ConversionModel struct {
+	DB       *sql.DB
+	InfoLog  *zerolog.Logger
+	ErrorLog *zerolog.Logger
+}
+
+// Insert records a conversion against the visit it is attributed to. A visitor only converts
+// once per goal, so recording the same goal for a visit again returns the existing conversion.
+// ErrRecordNotFound is returned if the visit doesn't exist.
+func (m ConversionModel) Insert(conversion *Conversion) error {
+	query := `
+		INSERT INTO conversions (visit_id, link_id, goal, value, is_bot)
+		SELECT id, link_id, $2, $3, is_bot
+		FROM visits
+		WHERE id = $1
+		ON CONFLICT (visit_id, goal) DO NOTHING
+		RETURNING id, link_id, created_at
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{conversion.VisitID, conversion.Goal, conversion.Value}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&conversion.ID, &conversion.LinkID, &conversion.CreatedAt)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// Either the visit doesn't exist, or the visit has already converted on this goal.
+	query = `
+		SELECT id, link_id, value, created_at
+		FROM conversions
+		WHERE visit_id = $1 AND goal = $2
+	`
+
+	err = m.DB.QueryRowContext(ctx, query, conversion.VisitID, conversion.Goal).Scan(
+		&conversion.ID,
+		&conversion.LinkID,
+		&conversion.Value,
+		&conversion.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getConversions counts the conversions attributed to a link per goal, and the share of visits
+// which converted on any goal. Conversions of visits by bots are only counted when includeBots is
+// true, matching the total visits. It must be called after the total visits have been counted.
+func (m VisitModel) getConversions(link *Link, includeBots bool, data *VisitData) error {
+	query := `
+		SELECT goal, count(*), sum(value),
+			(
+				SELECT count(DISTINCT visit_id)
+				FROM conversions
+				WHERE conversions.link_id = $1
+				AND (conversions.is_bot = FALSE OR $2)
+			)
+		FROM conversions
+		WHERE conversions.link_id = $1
+		AND (conversions.is_bot = FALSE OR $2)
+		GROUP BY goal
+		ORDER BY count(*) DESC, goal ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, link.ID, includeBots)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	data.Goals = []*GoalConversions{}
+
+	for rows.Next() {
+		var goal GoalConversions
+
+		if err := rows.Scan(&goal.Goal, &goal.Conversions, &goal.Value, &data.Conversions); err != nil {
+			return err
+		}
+
+		data.Goals = append(data.Goals, &goal)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if data.TotalVisits > 0 {
+		rate := float64(data.Conversions) / float64(data.TotalVisits) * 100
+		data.ConversionRate = math.Round(rate*100) / 100
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errInvalidCursor is returned when a cursor is malformed or its signature doesn't match.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the position of a row in a keyset paginated listing: the value of the column the
+// listing is sorted by and the row's ID, which breaks ties. A forward cursor selects the rows
+// after the position, and a backward one the rows before it. Scope is the search the listing was
+// filtered by when the cursor was issued.
+type cursor struct {
+	Sort     string `json:"s"`
+	Scope    string `json:"q,omitempty"`
+	Value    string `json:"v"`
+	ID       string `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// cursorKey is the sort key and ID of a row scanned from a paginated query, from which cursors
+// are created.
+type cursorKey struct {
+	Value string
+	ID    string
+}
+
+// encodeCursor returns the opaque form of a cursor given to clients, signed with key so that it
+// can't be forged to inject arbitrary sort values.
+func encodeCursor(key []byte, c cursor) string {
+	payload, _ := json.Marshal(c)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decodeCursor checks the signature of an opaque cursor and decodes it.
+func decodeCursor(key []byte, s string) (*cursor, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCursor, err)
+	}
+
+	return &c, nil
+}
+
+// currentCursor returns the cursor being paginated from, or nil when paginating by page. The
+// cursor is checked by ValidateFilters.
+func (f Filters) currentCursor() *cursor {
+	if f.Cursor == "" {
+		return nil
+	}
+
+	c, err := decodeCursor(f.CursorKey, f.Cursor)
+	if err != nil {
+		return nil
+	}
+
+	return c
+}
+
+// pageClauses are the parts of a query paginated by Filters.
+type pageClauses struct {
+	// Count is the column counting the total number of records, which is only counted when
+	// paginating by page.
+	Count string
+	// SortKey is the column holding the sort value of each row, as text.
+	SortKey string
+	// Where restricts the rows to those past the cursor.
+	Where   string
+	OrderBy string
+	Limit   string
+}
+
+// pageClauses returns the clauses paginating a query over table, along with their arguments,
+// which are numbered from n. Rows are sorted by the column named by the sort, or by the SQL
+// expression sortExprs maps the column to, if any. One more row than the page size is selected,
+// so that pageMetadata can tell whether there is another page. Rows are selected in reverse order
+// when paginating backwards, and put back in order by trimPage.
+func (f Filters) pageClauses(table string, n int, sortExprs map[string]string) (pageClauses, []interface{}) {
+	c := f.currentCursor()
+
+	column := table + "." + f.sortColumn()
+	if expr, ok := sortExprs[f.sortColumn()]; ok {
+		column = "(" + expr + ")"
+	}
+	id := table + ".id"
+	direction := f.sortDirection()
+
+	if c == nil {
+		return pageClauses{
+			Count:   "count(*) OVER()",
+			SortKey: column + "::text",
+			Where:   "TRUE",
+			OrderBy: fmt.Sprintf("%s %s, %s %s", column, direction, id, direction),
+			Limit:   fmt.Sprintf("LIMIT $%d OFFSET $%d", n, n+1),
+		}, []interface{}{f.limit() + 1, f.offset()}
+	}
+
+	if c.Backward {
+		if direction == "ASC" {
+			direction = "DESC"
+		} else {
+			direction = "ASC"
+		}
+	}
+
+	comparison := ">"
+	if direction == "DESC" {
+		comparison = "<"
+	}
+
+	return pageClauses{
+		Count:   "0",
+		SortKey: column + "::text",
+		Where:   fmt.Sprintf("(%s, %s) %s ($%d, $%d)", column, id, comparison, n, n+1),
+		OrderBy: fmt.Sprintf("%s %s, %s %s", column, direction, id, direction),
+		Limit:   fmt.Sprintf("LIMIT $%d", n+2),
+	}, []interface{}{c.Value, c.ID, f.limit() + 1}
+}
+
+// pageMetadata returns the metadata of a page from the total record count and the keys of the
+// rows selected by the pageClauses query, in the order they were selected.
+func (f Filters) pageMetadata(totalRecords int, keys []cursorKey) Metadata {
+	c := f.currentCursor()
+	var metadata Metadata
+	if c == nil {
+		metadata = calculateMetadata(totalRecords, f.Page, f.PageSize)
+	} else {
+		metadata = Metadata{PageSize: f.PageSize}
+	}
+
+	more := len(keys) > f.limit()
+	keys = trimPage(keys, f)
+
+	if len(keys) == 0 {
+		return metadata
+	}
+
+	first, last := keys[0], keys[len(keys)-1]
+
+	backward := c != nil && c.Backward
+	hasPrev := (c != nil && !backward) || (c == nil && f.Page > 1) || (backward && more)
+	hasNext := (!backward && more) || backward
+
+	if hasPrev {
+		metadata.PrevCursor = encodeCursor(f.CursorKey, cursor{Sort: f.Sort, Scope: f.CursorScope, Value: first.Value, ID: first.ID, Backward: true})
+	}
+
+	if hasNext {
+		metadata.NextCursor = encodeCursor(f.CursorKey, cursor{Sort: f.Sort, Scope: f.CursorScope, Value: last.Value, ID: last.ID})
+	}
+
+	return metadata
+}
+
+// trimPage drops the extra row selected by the pageClauses query, and puts rows selected
+// backwards back in order.
+func trimPage[T any](rows []T, f Filters) []T {
+	c := f.currentCursor()
+	if len(rows) > f.limit() {
+		rows = rows[:f.limit()]
+	}
+
+	if c != nil && c.Backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	return rows
+}
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/rs/zerolog"
+)
+
+// LinkDestination is one of several destinations a link splits its visits across, e.g. the arms
+// of a landing page experiment. Each visitor is assigned a destination with a probability
+// proportional to its weight.
+type LinkDestination struct {
+	ID          uuid.UUID `json:"id"`
+	LinkID      uuid.UUID `json:"link_id"`
+	Destination string    `json:"destination"`
+	Weight      int       `json:"weight"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"-"`
+	Version     int32     `json:"version"`
+}
+
+type VariantVisits struct {
+	ID          uuid.UUID `json:"id"`
+	Destination string    `json:"destination"`
+	Weight      int       `json:"weight"`
+	Visits      int       `json:"visits"`
+}
+
+// ChooseDestination picks one of the weighted destinations for a visitor identified by hash. The
+// same hash always picks the same destination, as long as the destinations don't change.
+func ChooseDestination(destinations []*LinkDestination, hash uint64) *LinkDestination {
+	total := 0
+	for _, destination := range destinations {
+		total += destination.Weight
+	}
+
+	if total <= 0 {
+		return nil
+	}
+
+	point := int(hash % uint64(total))
+
+	for _, destination := range destinations {
+		if point < destination.Weight {
+			return destination
+		}
+		point -= destination.Weight
+	}
+
+	return nil
+}
+
+// FindDestination returns the destination with the given ID, or nil if there isn't one.
+func FindDestination(destinations []*LinkDestination, id uuid.UUID) *LinkDestination {
+	for _, destination := range destinations {
+		if destination.ID == id {
+			return destination
+		}
+	}
+	return nil
+}
+
+func ValidateLinkDestination(v *validator.Validator, destination *LinkDestination) {
+	v.Check(destination.Destination != "", "destination", "must be provided")
+	if destination.Destination != "" {
+		u, err := url.Parse(destination.Destination)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "destination", "must be an absolute http or https URL")
+	}
+
+	v.Check(destination.Weight > 0, "weight", "must be greater than 0")
+	v.Check(destination.Weight <= 10_000, "weight", "must be a maximum of 10000")
+}
+
+type LinkDestinationModel struct {
+	DB       *sql.DB
+	InfoLog  *zerolog.Logger
+	ErrorLog *zerolog.Logger
+}
+
+func (m LinkDestinationModel) Insert(destination *LinkDestination) error {
+	query := `
+		INSERT INTO link_destinations (link_id, destination, weight)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{destination.LinkID, destination.Destination, destination.Weight}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&destination.ID, &destination.CreatedAt, &destination.Version)
+}
+
+func (m LinkDestinationModel) Get(linkID, id uuid.UUID) (*LinkDestination, error) {
+	query := `
+		SELECT id, link_id, destination, weight, created_at, updated_at, version
+		FROM link_destinations
+		WHERE link_id = $1 AND id = $2
+	`
+
+	var destination LinkDestination
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, linkID, id).Scan(
+		&destination.ID,
+		&destination.LinkID,
+		&destination.Destination,
+		&destination.Weight,
+		&destination.CreatedAt,
+		&destination.UpdatedAt,
+		&destination.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &destination, nil
+}
+
+// GetAllForLink returns the split destinations of a link, in a stable order so that visitors
+// keep being assigned the same destination.
+func (m LinkDestinationModel) GetAllForLink(linkID uuid.UUID) ([]*LinkDestination, error) {
+	query := `
+		SELECT id, link_id, destination, weight, created_at, updated_at, version
+		FROM link_destinations
+		WHERE link_id = $1
+		ORDER BY created_at ASC, id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	destinations := []*LinkDestination{}
+
+	for rows.Next() {
+		var destination LinkDestination
+
+		err := rows.Scan(
+			&destination.ID,
+			&destination.LinkID,
+			&destination.Destination,
+			&destination.Weight,
+			&destination.CreatedAt,
+			&destination.UpdatedAt,
+			&destination.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		destinations = append(destinations, &destination)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return destinations, nil
+}
+
+func (m LinkDestinationModel) Update(destination *LinkDestination) error {
+	query := `
+		UPDATE link_destinations
+		SET destination = $1, weight = $2, updated_at = NOW(), version = version + 1
+		WHERE id = $3 AND link_id = $4 AND version = $5
+		RETURNING version
+	`
+
+	args := []interface{}{
+		destination.Destination,
+		destination.Weight,
+		destination.ID,
+		destination.LinkID,
+		destination.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&destination.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m LinkDestinationModel) Delete(linkID, id uuid.UUID) error {
+	query := `
+		DELETE FROM link_destinations
+		WHERE link_id = $1 AND id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, linkID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// getVariantCounts counts the visits of each of a link's split destinations, from the daily
+// variant rollups and the un-rolled tail of raw visits.
+func (m VisitModel) getVariantCounts(link *Link, includeBots bool, data *VisitData) error {
+	query := fmt.Sprintf(`
+		SELECT link_destinations.id, link_destinations.destination, link_destinations.weight,
+			COALESCE(sum(counts.visits), 0)
+		FROM link_destinations
+		LEFT JOIN (
+			SELECT variant_id, visits
+			FROM visits_daily_variants
+			WHERE visits_daily_variants.link_id = $1
+			AND (visits_daily_variants.is_bot = FALSE OR $2)
+			UNION ALL
+			SELECT variant_id, count(*)
+			FROM visits
+			WHERE visits.link_id = $1
+			AND (visits.is_bot = FALSE OR $2)
+			AND variant_id IS NOT NULL
+			AND %s
+			GROUP BY variant_id
+		) AS counts ON counts.variant_id = link_destinations.id
+		WHERE link_destinations.link_id = $1
+		GROUP BY link_destinations.id
+		ORDER BY link_destinations.created_at ASC, link_destinations.id ASC
+	`, unrolledVisits)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, link.ID, includeBots)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	data.Variants = []*VariantVisits{}
+
+	for rows.Next() {
+		var variant VariantVisits
+
+		if err := rows.Scan(&variant.ID, &variant.Destination, &variant.Weight, &variant.Visits); err != nil {
+			return err
+		}
+
+		data.Variants = append(data.Variants, &variant)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,415 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/dnsverify"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// ErrDuplicateHostname is returned when a domain with the same hostname already exists.
+	ErrDuplicateHostname = errors.New("duplicate hostname")
+
+	// ErrDomainInUse is returned when deleting a domain which still has links.
+	ErrDomainInUse = errors.New("domain in use")
+)
+
+// Domain verification statuses. Domains start out pending, and become verified once their
+// challenge record is found, or failed if it isn't found within the verification window.
+const (
+	DomainPending  = "pending"
+	DomainVerified = "verified"
+	DomainFailed   = "failed"
+)
+
+// HostnameRX matches lowercase DNS hostnames with at least two labels.
+var HostnameRX = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// domainColumns are the columns scanned by scanDomain.
+const domainColumns = `id, hostname, fallback_url, status, verified_at, verification_token,
+	verification_error, verification_started_at, checked_at, created_at, updated_at, version`
+
+// Domain is a custom domain links can be served from once it has been verified. Requests to the
+// domain for a token which doesn't exist are redirected to its fallback URL, if it has one.
+type Domain struct {
+	ID                    uuid.UUID           `json:"id"`
+	Hostname              string              `json:"hostname"`
+	FallbackURL           string              `json:"fallback_url"`
+	Status                string              `json:"status"`
+	VerifiedAt            *time.Time          `json:"verified_at"`
+	VerificationToken     string              `json:"-"`
+	Verification          dnsverify.Challenge `json:"verification"`
+	VerificationError     string              `json:"verification_error"`
+	VerificationStartedAt time.Time           `json:"verification_started_at"`
+	CheckedAt             *time.Time          `json:"checked_at"`
+	CreatedAt             time.Time           `json:"created_at"`
+	UpdatedAt             time.Time           `json:"-"`
+	Version               int32               `json:"version"`
+}
+
+// scanDomain scans the domainColumns of a row into domain, preceded by any extra destinations.
+func scanDomain(row interface{ Scan(...interface{}) error }, domain *Domain, extra ...interface{}) error {
+	dest := append(extra,
+		&domain.ID,
+		&domain.Hostname,
+		&domain.FallbackURL,
+		&domain.Status,
+		&domain.VerifiedAt,
+		&domain.VerificationToken,
+		&domain.VerificationError,
+		&domain.VerificationStartedAt,
+		&domain.CheckedAt,
+		&domain.CreatedAt,
+		&domain.UpdatedAt,
+		&domain.Version,
+	)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	domain.Verification = dnsverify.ChallengeFor(domain.Hostname, domain.VerificationToken)
+
+	return nil
+}
+
+func ValidateDomain(v *validator.Validator, domain *Domain) {
+	v.Check(domain.Hostname != "", "hostname", "must be provided")
+	v.Check(len(domain.Hostname) <= 253, "hostname", "must not be more than 253 bytes long")
+	v.Check(domain.Hostname == "" || validator.Matches(domain.Hostname, HostnameRX), "hostname", "must be a valid lowercase hostname")
+
+	if domain.FallbackURL != "" {
+		u, err := url.Parse(domain.FallbackURL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "fallback_url", "must be an absolute http or https URL")
+	}
+}
+
+type DomainModel struct {
+	DB       *sql.DB
+	InfoLog  *zerolog.Logger
+	ErrorLog *zerolog.Logger
+}
+
+func (m DomainModel) Insert(domain *Domain) error {
+	query := `
+		INSERT INTO domains (hostname, fallback_url, verification_token)
+		VALUES ($1, $2, $3)
+		RETURNING ` + domainColumns
+
+	token, err := dnsverify.NewToken()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{domain.Hostname, domain.FallbackURL, token}
+
+	err = scanDomain(m.DB.QueryRowContext(ctx, query, args...), domain)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "domains_hostname_key"`:
+			return ErrDuplicateHostname
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m DomainModel) Get(id uuid.UUID) (*Domain, error) {
+	query := `
+		SELECT ` + domainColumns + `
+		FROM domains
+		WHERE id = $1
+	`
+
+	return m.get(query, id)
+}
+
+// GetByHostname returns the domain with the given hostname.
+func (m DomainModel) GetByHostname(hostname string) (*Domain, error) {
+	query := `
+		SELECT ` + domainColumns + `
+		FROM domains
+		WHERE hostname = $1
+	`
+
+	return m.get(query, hostname)
+}
+
+func (m DomainModel) get(query string, args ...interface{}) (*Domain, error) {
+	var domain Domain
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := scanDomain(m.DB.QueryRowContext(ctx, query, args...), &domain)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &domain, nil
+}
+
+func (m DomainModel) GetAll(filters Filters) ([]*Domain, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+domainColumns+`
+		FROM domains
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	totalRecords := 0
+	domains := []*Domain{}
+
+	for rows.Next() {
+		var domain Domain
+
+		err := scanDomain(rows, &domain, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		domains = append(domains, &domain)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return domains, metadata, nil
+}
+
+// Update updates the fallback URL of a domain. A domain's hostname can't be changed, as its
+// links' short URLs would change with it.
+func (m DomainModel) Update(domain *Domain) error {
+	query := `
+		UPDATE domains
+		SET fallback_url = $1, updated_at = NOW(), version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version
+	`
+
+	args := []interface{}{domain.FallbackURL, domain.ID, domain.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&domain.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m DomainModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM domains
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: update or delete on table "domains" violates foreign key constraint "links_domain_id_fkey" on table "links"`:
+			return ErrDomainInUse
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ClaimPending claims up to limit pending domains which are due to be checked. Claimed domains
+// aren't handed out again until recheckIn has passed, so each is checked at most once per period
+// however often the verifier runs.
+func (m DomainModel) ClaimPending(limit int, recheckIn time.Duration) ([]*Domain, error) {
+	query := `
+		UPDATE domains
+		SET next_check_at = NOW() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id
+			FROM domains
+			WHERE status = 'pending' AND next_check_at <= NOW()
+			ORDER BY next_check_at ASC
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + domainColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, recheckIn.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	domains := []*Domain{}
+
+	for rows.Next() {
+		var domain Domain
+
+		if err := scanDomain(rows, &domain); err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, &domain)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+// checkedStatus returns the status of a pending domain whose verification started at startedAt,
+// after a check at now which failed with checkErr. The domain is verified if checkErr is nil, and
+// otherwise fails once the verification window has passed, staying pending until then.
+func checkedStatus(checkErr error, startedAt, now time.Time, window time.Duration) string {
+	switch {
+	case checkErr == nil:
+		return DomainVerified
+	case !now.Before(startedAt.Add(window)):
+		return DomainFailed
+	default:
+		return DomainPending
+	}
+}
+
+// RecordCheck records the outcome of checking a pending domain's challenge record, moving it to
+// the status given by checkedStatus. Domains which are no longer pending, or whose verification
+// has since been restarted, are left untouched.
+func (m DomainModel) RecordCheck(domain *Domain, checkErr error, window time.Duration) error {
+	query := `
+		UPDATE domains
+		SET status = $2,
+			verified_at = CASE WHEN $2 = 'verified' THEN NOW() ELSE verified_at END,
+			verification_error = $3,
+			checked_at = NOW(),
+			updated_at = NOW(),
+			version = version + 1
+		WHERE id = $1 AND status = 'pending' AND verification_started_at = $4
+		RETURNING status, verified_at, verification_error, checked_at, version
+	`
+
+	errMessage := ""
+	if checkErr != nil {
+		errMessage = checkErr.Error()
+	}
+
+	status := checkedStatus(checkErr, domain.VerificationStartedAt, time.Now(), window)
+
+	args := []interface{}{domain.ID, status, errMessage, domain.VerificationStartedAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&domain.Status,
+		&domain.VerifiedAt,
+		&domain.VerificationError,
+		&domain.CheckedAt,
+		&domain.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestartVerification moves a failed domain back to pending, starting a new verification window.
+func (m DomainModel) RestartVerification(domain *Domain) error {
+	query := `
+		UPDATE domains
+		SET status = 'pending', verification_error = '', verification_started_at = NOW(),
+			next_check_at = NOW(), updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND status = 'failed'
+		RETURNING status, verification_error, verification_started_at, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, domain.ID, domain.Version).Scan(
+		&domain.Status,
+		&domain.VerificationError,
+		&domain.VerificationStartedAt,
+		&domain.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
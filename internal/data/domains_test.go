@@ -0,0 +1,38 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/dnsverify"
+)
+
+func TestCheckedStatus(t *testing.T) {
+	startedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	window := 72 * time.Hour
+
+	tests := []struct {
+		name     string
+		checkErr error
+		now      time.Time
+		want     string
+	}{
+		{"verified", nil, startedAt.Add(time.Minute), DomainVerified},
+		{"verified after the window", nil, startedAt.Add(2 * window), DomainVerified},
+		{"missing record within the window", dnsverify.ErrNoRecord, startedAt.Add(time.Hour), DomainPending},
+		{"mismatch within the window", dnsverify.ErrMismatch, startedAt.Add(window - time.Second), DomainPending},
+		{"lookup error within the window", errors.New("i/o timeout"), startedAt.Add(time.Hour), DomainPending},
+		{"missing record once the window ends", dnsverify.ErrNoRecord, startedAt.Add(window), DomainFailed},
+		{"mismatch after the window", dnsverify.ErrMismatch, startedAt.Add(window + time.Hour), DomainFailed},
+		{"lookup error after the window", errors.New("i/o timeout"), startedAt.Add(window + time.Hour), DomainFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkedStatus(tt.checkErr, startedAt, tt.now, window); got != tt.want {
+				t.Errorf("got status %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,14 +12,25 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+
+	// Cursor is an opaque cursor from the metadata of a previous page, which is paginated from
+	// instead of Page when set. Cursors are signed with CursorKey.
+	Cursor    string
+	CursorKey []byte
+
+	// CursorScope is the search the listing is filtered by, e.g. its q parameter, which cursors
+	// are bound to, as the rows' sort values, such as their relevance, may depend on it.
+	CursorScope string
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -38,12 +49,19 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than 0")
-	v.Check(f.Page <= 10_000_0000, "", "must be a maximum of 10 million")
+	v.Check(f.Page <= 10_000, "page", "must be a maximum of 10000, use cursor to page further")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than 0")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.CursorKey, f.Cursor)
+		v.Check(err == nil, "cursor", "invalid cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "was issued for a different sort")
+		v.Check(err != nil || c.Scope == f.CursorScope, "cursor", "was issued for a different q")
+	}
 }
 
 // sortColumn checks that the client-provided Sort field matches one of the entries in our
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// linkStatsColumns are the visit counters of a link, selected from link_stats.
+const linkStatsColumns = `link_stats.total_visits, link_stats.visits_7d, link_stats.last_visited_at`
+
+// linkStatsSorts maps the sorts by visit counters to the link_stats columns they sort by. Links
+// which have never been visited sort as if visited at the beginning of time, so that cursors
+// never have to seek past a NULL.
+var linkStatsSorts = map[string]string{
+	"total_visits":    "link_stats.total_visits",
+	"visits_7d":       "link_stats.visits_7d",
+	"last_visited_at": "COALESCE(link_stats.last_visited_at, '-infinity')",
+}
+
+// insertLinkStats creates the visit counters of a new link.
+func insertLinkStats(ctx context.Context, tx *sql.Tx, linkID uuid.UUID) error {
+	query := `
+		INSERT INTO link_stats (link_id)
+		VALUES ($1)
+		ON CONFLICT DO NOTHING
+		`
+
+	_, err := tx.ExecContext(ctx, query, linkID)
+	return err
+}
+
+// linkStatsLock is the advisory lock key held while changing the visit counters in the
+// background, so that recounting the last seven days can't overwrite increments made meanwhile.
+const linkStatsLock = 0x6c696e6b7374
+
+// linkCountBatch is the maximum number of visits folded into the counters in one transaction.
+const linkCountBatch = 10_000
+
+// countVisit queues a visit made at the given time to be added to its link's counters. The
+// counters aren't updated straight away, as every visit of a link would then wait on the lock of
+// its counters' row, which serialises the redirects of popular links. CountVisits adds the queued
+// visits to the counters instead.
+func countVisit(ctx context.Context, tx *sql.Tx, linkID uuid.UUID, createdAt time.Time) error {
+	query := `
+		INSERT INTO link_visit_increments (link_id, created_at)
+		VALUES ($1, $2)
+		`
+
+	_, err := tx.ExecContext(ctx, query, linkID, createdAt)
+	return err
+}
+
+// CountVisits adds the visits queued by countVisit to their links' counters, a batch at a time,
+// returning the number of visits counted. If another instance is already counting, nothing is
+// counted.
+func (m LinkModel) CountVisits() (int64, error) {
+	var counted int64
+
+	for {
+		n, err := m.countVisitBatch()
+		counted += n
+
+		if err != nil || n < linkCountBatch {
+			return counted, err
+		}
+	}
+}
+
+func (m LinkModel) countVisitBatch() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var locked bool
+
+	err = tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, linkStatsLock).Scan(&locked)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	// Visits from before the last seven days, e.g. seeded ones, only count towards the total.
+	query := `
+		WITH pending AS (
+			DELETE FROM link_visit_increments
+			WHERE id IN (SELECT id FROM link_visit_increments ORDER BY id LIMIT $1)
+			RETURNING link_id, created_at
+		), daily AS (
+			INSERT INTO link_daily_visits (link_id, day, visits)
+			SELECT link_id, CAST(created_at as DATE), count(*)
+			FROM pending
+			WHERE created_at >= CURRENT_DATE - 6
+			GROUP BY 1, 2
+			ON CONFLICT (link_id, day) DO UPDATE SET visits = link_daily_visits.visits + EXCLUDED.visits
+		)
+		UPDATE link_stats
+		SET total_visits = link_stats.total_visits + counts.visits,
+			visits_7d = link_stats.visits_7d + counts.recent_visits,
+			last_visited_at = GREATEST(link_stats.last_visited_at, counts.last_visited_at)
+		FROM (
+			SELECT link_id, count(*) AS visits,
+				count(*) FILTER (WHERE created_at >= CURRENT_DATE - 6) AS recent_visits,
+				max(created_at) AS last_visited_at
+			FROM pending
+			GROUP BY link_id
+		) AS counts
+		WHERE link_stats.link_id = counts.link_id
+		RETURNING counts.visits
+		`
+
+	rows, err := tx.QueryContext(ctx, query, linkCountBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	var counted int64
+
+	for rows.Next() {
+		var visits int64
+
+		if err := rows.Scan(&visits); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+
+		counted += visits
+	}
+
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return counted, tx.Commit()
+}
+
+// RefreshRecentVisits recounts the visits of the last seven days of the links whose count has
+// changed as days fell out of the window, and discards the daily counts which have. It returns
+// the number of links recounted.
+func (m LinkModel) RefreshRecentVisits() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Wait for any batch of visits being counted, and keep further batches out until done, so
+	// the recount can't overwrite their increments.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, linkStatsLock)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		DELETE FROM link_daily_visits
+		WHERE day < CURRENT_DATE - 6
+		`
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return 0, err
+	}
+
+	query = `
+		UPDATE link_stats
+		SET visits_7d = recent.visits
+		FROM (
+			SELECT link_stats.link_id, COALESCE(sum(link_daily_visits.visits), 0) AS visits
+			FROM link_stats
+			LEFT JOIN link_daily_visits ON link_daily_visits.link_id = link_stats.link_id
+			WHERE link_stats.visits_7d > 0
+			GROUP BY link_stats.link_id
+		) AS recent
+		WHERE link_stats.link_id = recent.link_id
+		AND link_stats.visits_7d <> recent.visits
+		`
+
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	recounted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return recounted, tx.Commit()
+}
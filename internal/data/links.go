@@ -3,8 +3,11 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,42 +15,116 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// ErrDuplicateToken is returned when a link with the same token already exists on the domain.
+var ErrDuplicateToken = errors.New("duplicate token")
+
 type Link struct {
-	ID          uuid.UUID `json:"id"`
-	Name        string    `json:"name"`
-	Destination string    `json:"destination"`
-	Token       string    `json:"token"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"-"`
-	Version     int32     `json:"version"`
+	ID          uuid.UUID  `json:"id"`
+	Name        string     `json:"name"`
+	Destination string     `json:"destination"`
+	Token       string     `json:"token"`
+	DomainID    *uuid.UUID `json:"domain_id"`
+	Domain      string     `json:"domain"`
+	ShortURL    string     `json:"short_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"-"`
+	Version     int32      `json:"version"`
+
+	// Visit counters, which leave out visits by bots.
+	TotalVisits   int64      `json:"total_visits"`
+	Visits7d      int64      `json:"visits_7d"`
+	LastVisitedAt *time.Time `json:"last_visited_at"`
 }
 
 type LinkModel struct {
 	DB       *sql.DB
 	InfoLog  *zerolog.Logger
 	ErrorLog *zerolog.Logger
+
+	// ShortURLBase is the public URL of the default domain, e.g. https://shrtnr.example, and
+	// RedirectPrefix the path which tokens are appended to, e.g. /a/. Links are returned without
+	// a short URL when ShortURLBase is empty.
+	ShortURLBase   string
+	RedirectPrefix string
+}
+
+// setShortURL sets the short URL of a link. Links on a custom domain are served from it over
+// HTTPS, and all other links from the default domain.
+func (m LinkModel) setShortURL(link *Link) {
+	switch {
+	case link.Domain != "":
+		link.ShortURL = "https://" + link.Domain + m.RedirectPrefix + url.PathEscape(link.Token)
+	case m.ShortURLBase != "":
+		link.ShortURL = m.ShortURLBase + m.RedirectPrefix + url.PathEscape(link.Token)
+	default:
+		link.ShortURL = ""
+	}
+}
+
+// isDuplicateToken reports whether err is a violation of the uniqueness of tokens on a domain.
+func isDuplicateToken(err error) bool {
+	switch err.Error() {
+	case `pq: duplicate key value violates unique constraint "links_token_key"`,
+		`pq: duplicate key value violates unique constraint "links_domain_id_token_key"`:
+		return true
+	default:
+		return false
+	}
 }
 
 func (m LinkModel) Insert(link *Link) error {
 	query := `
-		INSERT INTO links (name, destination, token)
-		VALUES ($1, $2, $3)
-		RETURNING id, created_at, version
+		INSERT INTO links (name, destination, token, domain_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version,
+			COALESCE((SELECT hostname FROM domains WHERE domains.id = links.domain_id), '')
 		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{link.Name, link.Destination, link.Token}
+	args := []interface{}{link.Name, link.Destination, link.Token, link.DomainID}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&link.ID, &link.CreatedAt, &link.Version, &link.Domain)
+	if err != nil {
+		switch {
+		case isDuplicateToken(err):
+			return ErrDuplicateToken
+		default:
+			return err
+		}
+	}
+
+	m.setShortURL(link)
+
+	if err := insertLinkStats(ctx, tx, link.ID); err != nil {
+		return err
+	}
+
+	if err := insertOutboxEvent(ctx, tx, link.ID, EventLinkCreated, link); err != nil {
+		return err
+	}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&link.ID, &link.CreatedAt, &link.Version)
+	return tx.Commit()
 }
 
 func (m LinkModel) Get(id uuid.UUID) (*Link, error) {
 	query := `
-		SELECT id, name, destination, token, created_at, updated_at, version
+		SELECT links.id, name, destination, token, domain_id, COALESCE(domains.hostname, ''),
+			links.created_at, links.updated_at, links.version, ` + linkStatsColumns + `
 		FROM links
-		WHERE id = $1
+		JOIN link_stats ON link_stats.link_id = links.id
+		LEFT JOIN domains ON domains.id = links.domain_id
+		WHERE links.id = $1
 	`
 
 	var link Link
@@ -60,9 +137,14 @@ func (m LinkModel) Get(id uuid.UUID) (*Link, error) {
 		&link.Name,
 		&link.Destination,
 		&link.Token,
+		&link.DomainID,
+		&link.Domain,
 		&link.CreatedAt,
 		&link.UpdatedAt,
 		&link.Version,
+		&link.TotalVisits,
+		&link.Visits7d,
+		&link.LastVisitedAt,
 	)
 
 	if err != nil {
@@ -74,28 +156,91 @@ func (m LinkModel) Get(id uuid.UUID) (*Link, error) {
 		}
 	}
 
+	m.setShortURL(&link)
+
 	return &link, nil
 }
 
-func (m LinkModel) GetAll(name string, filters Filters) ([]*Link, Metadata, error) {
-	// Add an ORDER BY clause and interpolate the sort column and direction using fmt.Sprintf.
-	// Importantly, notice that we also include a secondary sort on the movie ID to ensure
-	// a consistent ordering. Furthermore, we include LIMIT and OFFSET clauses with placeholder
-	// parameter values for pagination implementation. The window function is used to calculate
-	// the total filtered rows which will be used in our pagination metadata.
+// LinkFilter narrows a listing of links. Zero fields match every link.
+type LinkFilter struct {
+	// Name matches the words of link names.
+	Name string
+	// Query fuzzily matches link names, destinations and tokens.
+	Query         string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Domain matches the hostname of links' custom domain, or the links on the default domain if
+	// DefaultDomain is set.
+	Domain        string
+	DefaultDomain bool
+}
+
+// linkRelevance ranks links by how closely their name, destination or token match the query in
+// $2, negated so that the most relevant links sort first.
+const linkRelevance = `-GREATEST(word_similarity($2, COALESCE(links.name, '')),
+	word_similarity($2, COALESCE(links.destination, '')), word_similarity($2, links.token))`
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (m LinkModel) GetAll(filter LinkFilter, filters Filters) ([]*Link, Metadata, error) {
+	// Paginate by the sort column, with a secondary sort on the link ID to ensure a consistent
+	// ordering. Pages are selected either with LIMIT and OFFSET, using a window function to count
+	// the total filtered rows for the pagination metadata, or from a cursor, seeking past the
+	// sort value and ID it holds.
+	sortExprs := map[string]string{"relevance": linkRelevance}
+	for sort, expr := range linkStatsSorts {
+		sortExprs[sort] = expr
+	}
+
+	page, pageArgs := filters.pageClauses("links", 8, sortExprs)
+
+	// The query matches links whose name, destination or token contain a word similar to it, or
+	// contain it outright, both of which are served by the trigram indexes.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, name, destination, token, created_at, updated_at, version
+		SELECT %s, %s, links.id, name, destination, token, domain_id,
+			COALESCE(domains.hostname, ''), links.created_at, links.updated_at, links.version,
+			%s
 		FROM links
+		JOIN link_stats ON link_stats.link_id = links.id
+		LEFT JOIN domains ON domains.id = links.domain_id
 		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $2 OFFSET $3`,
-		filters.sortColumn(), filters.sortDirection())
+		AND ($2 = ''
+			OR $2 <%% links.name OR $2 <%% links.destination OR $2 <%% links.token
+			OR links.name ILIKE $3 OR links.destination ILIKE $3 OR links.token ILIKE $3)
+		AND (links.created_at >= $4 OR $4 IS NULL)
+		AND (links.created_at < $5 OR $5 IS NULL)
+		AND (domains.hostname = $6 OR $6 = '')
+		AND (links.domain_id IS NULL OR NOT $7)
+		AND %s
+		ORDER BY %s
+		%s`,
+		page.Count, page.SortKey, linkStatsColumns, page.Where, page.OrderBy, page.Limit)
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{name, filters.limit(), filters.offset()}
+	var createdAfter, createdBefore *time.Time
+	if !filter.CreatedAfter.IsZero() {
+		createdAfter = &filter.CreatedAfter
+	}
+	if !filter.CreatedBefore.IsZero() {
+		createdBefore = &filter.CreatedBefore
+	}
+
+	args := []interface{}{
+		filter.Name,
+		filter.Query,
+		"%" + escapeLike(filter.Query) + "%",
+		createdAfter,
+		createdBefore,
+		filter.Domain,
+		filter.DefaultDomain,
+	}
+	args = append(args, pageArgs...)
 
 	// Use QueryContext to execute the query. This returns a sql.Rows result set containing
 	// the result.
@@ -114,25 +259,36 @@ func (m LinkModel) GetAll(name string, filters Filters) ([]*Link, Metadata, erro
 
 	totalRecords := 0
 	links := []*Link{}
+	keys := []cursorKey{}
 
 	for rows.Next() {
 		var link Link
+		var sortKey string
 
 		err := rows.Scan(
 			&totalRecords, // Scan the count from the window function into totalRecords.
+			&sortKey,
 			&link.ID,
 			&link.Name,
 			&link.Destination,
 			&link.Token,
+			&link.DomainID,
+			&link.Domain,
 			&link.CreatedAt,
 			&link.UpdatedAt,
 			&link.Version,
+			&link.TotalVisits,
+			&link.Visits7d,
+			&link.LastVisitedAt,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
+		m.setShortURL(&link)
+
 		links = append(links, &link)
+		keys = append(keys, cursorKey{Value: sortKey, ID: link.ID.String()})
 	}
 
 	// When the rows.Next() loop has finished, call rows.Err() to retrieve any error
@@ -141,26 +297,32 @@ func (m LinkModel) GetAll(name string, filters Filters) ([]*Link, Metadata, erro
 		return nil, Metadata{}, err
 	}
 
-	// Generate a Metadata struct, passing in the total record count and pagination parameters
-	// from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// Generate a Metadata struct from the total record count and the rows on either side of the
+	// page, before trimming the extra row selected to tell whether there is a next page.
+	metadata := filters.pageMetadata(totalRecords, keys)
 
-	// If everything went OK, then return the slice of the movies and metadata.
-	return links, metadata, nil
+	// If everything went OK, then return the slice of the links and metadata.
+	return trimPage(links, filters), metadata, nil
 }
 
 func (m LinkModel) Update(link *Link) error {
 	query := `
 		UPDATE links
-		SET name = $1, destination = $2, token = $3, updated_at = NOW(), version = version + 1
-		WHERE id = $4 AND version = $5
-		RETURNING version
+		SET name = $1, destination = $2, token = $3, domain_id = $4, updated_at = NOW(),
+			version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version,
+			COALESCE((SELECT hostname FROM domains WHERE domains.id = links.domain_id), ''),
+			(SELECT total_visits FROM link_stats WHERE link_stats.link_id = links.id),
+			(SELECT visits_7d FROM link_stats WHERE link_stats.link_id = links.id),
+			(SELECT last_visited_at FROM link_stats WHERE link_stats.link_id = links.id)
 	`
 
 	args := []interface{}{
 		link.Name,
 		link.Destination,
 		link.Token,
+		link.DomainID,
 		link.ID,
 		link.Version, // Add the expected link version.
 	}
@@ -168,17 +330,34 @@ func (m LinkModel) Update(link *Link) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&link.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&link.Version, &link.Domain, &link.TotalVisits, &link.Visits7d, &link.LastVisitedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		case isDuplicateToken(err):
+			return ErrDuplicateToken
 		default:
 			return err
 		}
 	}
 
-	return nil
+	m.setShortURL(link)
+
+	if err := insertOutboxEvent(ctx, tx, link.ID, EventLinkUpdated, link); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (m LinkModel) Delete(id uuid.UUID) error {
@@ -190,10 +369,19 @@ func (m LinkModel) Delete(id uuid.UUID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
 	// Execute the SQL query using the Exec() method,
 	// passing in the id variable as the value for the placeholder parameter. The Exec(
 	// ) method returns a sql.Result object.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -212,26 +400,43 @@ func (m LinkModel) Delete(id uuid.UUID) error {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	if err := insertOutboxEvent(ctx, tx, id, EventLinkDeleted, map[string]uuid.UUID{"id": id}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func ValidateLink(v *validator.Validator, link *Link) {
 	// TODO
 }
 
-func (m LinkModel) GetByToken(token string) (*Link, error) {
+// GetByToken returns the link with the given token on a custom domain, or on the default domain
+// if domainID is nil.
+func (m LinkModel) GetByToken(domainID *uuid.UUID, token string) (*Link, error) {
 	query := `
 		SELECT id, destination
 		FROM links
-		WHERE token = $1
+		WHERE token = $1 AND domain_id IS NULL
 	`
 
+	args := []interface{}{token}
+
+	if domainID != nil {
+		query = `
+			SELECT id, destination
+			FROM links
+			WHERE token = $1 AND domain_id = $2
+		`
+		args = append(args, *domainID)
+	}
+
 	var link Link
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, token).Scan(
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&link.ID,
 		&link.Destination,
 	)
@@ -248,6 +453,77 @@ func (m LinkModel) GetByToken(token string) (*Link, error) {
 	return &link, nil
 }
 
+// Redirect is what a visit to a link needs to be redirected: the link, along with its rules in
+// order and its split destinations.
+type Redirect struct {
+	Link         *Link
+	Rules        []*LinkRule
+	Destinations []*LinkDestination
+}
+
+// GetRedirect returns the redirect of the link with the given token on a custom domain, or on the
+// default domain if domainID is nil. The link's rules and destinations are fetched along with it,
+// so that a redirect takes a single query however many features it supports.
+func (m LinkModel) GetRedirect(domainID *uuid.UUID, token string) (*Redirect, error) {
+	where := `token = $1 AND domain_id IS NULL`
+	args := []interface{}{token}
+
+	if domainID != nil {
+		where = `token = $1 AND domain_id = $2`
+		args = append(args, *domainID)
+	}
+
+	query := `
+		SELECT links.id, links.destination,
+			COALESCE((
+				SELECT json_agg(rules ORDER BY rules.position, rules.created_at, rules.id)
+				FROM (
+					SELECT id, link_id, position, destination, countries, devices, operating_systems,
+						languages, starts_at, ends_at, created_at, version
+					FROM link_rules
+					WHERE link_rules.link_id = links.id
+				) AS rules
+			), '[]'),
+			COALESCE((
+				SELECT json_agg(destinations ORDER BY destinations.created_at, destinations.id)
+				FROM (
+					SELECT id, link_id, destination, weight, created_at, version
+					FROM link_destinations
+					WHERE link_destinations.link_id = links.id
+				) AS destinations
+			), '[]')
+		FROM links
+		WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var link Link
+	var rules, destinations []byte
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&link.ID, &link.Destination, &rules, &destinations)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	redirect := &Redirect{Link: &link}
+
+	if err := json.Unmarshal(rules, &redirect.Rules); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(destinations, &redirect.Destinations); err != nil {
+		return nil, err
+	}
+
+	return redirect, nil
+}
+
 func (m LinkModel) GenerateNewToken() string {
 	token := generateRandStr(5)
 	return token
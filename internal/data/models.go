@@ -14,26 +14,67 @@ var (
 
 	// ErrEditConflict is returned when a there is a data race, and we have an edit conflict.
 	ErrEditConflict = errors.New("edit conflict")
+
+	// ErrBackdatedVisit is returned when seeding a visit older than the rollup watermark, as it
+	// would never be rolled up.
+	ErrBackdatedVisit = errors.New("visit is older than the rollup watermark")
 )
 
 type Models struct {
-	Links  LinkModel
-	Visits VisitModel
+	Conversions  ConversionModel
+	Links        LinkModel
+	Destinations LinkDestinationModel
+	Domains      DomainModel
+	Outbox       OutboxModel
+	Rules        LinkRuleModel
+	Visits       VisitModel
+	Webhooks     WebhookModel
 }
 
 func NewModels(db *sql.DB) Models {
 	infoLog := zerolog.New(os.Stdout).With().Logger()
 	errorLog := zerolog.New(os.Stderr).With().Logger()
 	return Models{
+		Conversions: ConversionModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
+		},
+		Domains: DomainModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
+		},
 		Links: LinkModel{
 			DB:       db,
 			InfoLog:  &infoLog,
 			ErrorLog: &errorLog,
 		},
+		Destinations: LinkDestinationModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
+		},
+		Outbox: OutboxModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
+		},
+		Rules: LinkRuleModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
+		},
 		Visits: VisitModel{
 			DB:       db,
 			InfoLog:  &infoLog,
 			ErrorLog: &errorLog,
+			salts:    &saltCache{},
+		},
+		Webhooks: WebhookModel{
+			DB:       db,
+			InfoLog:  &infoLog,
+			ErrorLog: &errorLog,
 		},
 	}
 }
@@ -0,0 +1,232 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/matthewsaunders/link-shortener-api/internal/outbox"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/rs/zerolog"
+)
+
+// Event types recorded in the outbox.
+const (
+	EventLinkCreated  = "link.created"
+	EventLinkUpdated  = "link.updated"
+	EventLinkDeleted  = "link.deleted"
+	EventVisitCreated = "visit.created"
+)
+
+// EventTypes lists every event type.
+var EventTypes = []string{EventLinkCreated, EventLinkUpdated, EventLinkDeleted, EventVisitCreated}
+
+// outboxRelayLock is the advisory lock key held while relaying the outbox, which ensures a
+// single relay publishes events at a time and so publishes them in order.
+const outboxRelayLock = 0x6f7574626f78
+
+// outboxLinkLock is the advisory lock class of the per link locks held while recording a link's
+// events in the outbox. The lock's key within the class is a hash of the link's ID.
+const outboxLinkLock = 0x6f7574
+
+// insertOutboxEvent records an event about a link in the outbox, as part of the transaction
+// making the change the event describes. It must be the transaction's last statement.
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, linkID uuid.UUID, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// Event IDs are only in order of commit if the transactions recording a link's events commit
+	// in the order they took their IDs, otherwise the relay could publish an event before an
+	// earlier one it can't see yet. So hold a lock on the link from taking the ID until commit,
+	// which is kept short by recording the event last.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, outboxLinkLock, linkID.String())
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO outbox (link_id, event, payload)
+		VALUES ($1, $2, $3)
+		`
+
+	_, err = tx.ExecContext(ctx, query, linkID, event, payload)
+	return err
+}
+
+type OutboxModel struct {
+	DB       *sql.DB
+	InfoLog  *zerolog.Logger
+	ErrorLog *zerolog.Logger
+}
+
+// pendingEvent is an event in the outbox, along with the sinks which have already published it.
+type pendingEvent struct {
+	outbox.Event
+	publishedTo []string
+}
+
+// Relay publishes up to limit of the oldest events in the outbox to each of the named sinks,
+// returning how many events every sink has now published. Those events are deleted, while the
+// sinks which have published the others are recorded, so a failing sink doesn't cause the others
+// to be sent an event again. An event which a sink fails to publish holds back the later events
+// of the same link for that sink only, so each link's events reach each sink in order.
+//
+// Events are published outside of any transaction, so slow sinks don't hold one open. Instead
+// the relay holds a session advisory lock for the duration, and if another relay is already
+// running nothing is published.
+func (m OutboxModel) Relay(limit int, sinks []string, publish func(event outbox.Event, sink string) error) (int, error) {
+	conn, err := m.DB.Conn(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var locked bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, outboxRelayLock).Scan(&locked)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, outboxRelayLock); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	events, err := m.pending(ctx, conn, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	type heldSink struct {
+		link uuid.UUID
+		sink string
+	}
+
+	var done []int64
+	var publishErr error
+	held := map[heldSink]bool{}
+
+	for _, event := range events {
+		publishedTo := append([]string{}, event.publishedTo...)
+		pending := 0
+
+		for _, sink := range sinks {
+			if validator.In(sink, publishedTo...) {
+				continue
+			}
+
+			if held[heldSink{event.LinkID, sink}] {
+				pending++
+				continue
+			}
+
+			if err := publish(event.Event, sink); err != nil {
+				held[heldSink{event.LinkID, sink}] = true
+				pending++
+				if publishErr == nil {
+					publishErr = err
+				}
+				continue
+			}
+
+			publishedTo = append(publishedTo, sink)
+		}
+
+		switch {
+		case pending == 0:
+			done = append(done, event.ID)
+		case len(publishedTo) > len(event.publishedTo):
+			err := m.recordPublished(conn, event.ID, publishedTo)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(done) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		_, err = conn.ExecContext(ctx, `DELETE FROM outbox WHERE id = ANY($1)`, pq.Array(done))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(done), publishErr
+}
+
+// recordPublished records the sinks which have published an event which is still waiting on others.
+func (m OutboxModel) recordPublished(conn *sql.Conn, id int64, sinks []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := conn.ExecContext(ctx, `UPDATE outbox SET published_to = $2 WHERE id = $1`, id, pq.Array(sinks))
+	return err
+}
+
+// pending returns up to limit of the oldest events in the outbox. Each link's events are in the
+// order they were committed, see insertOutboxEvent.
+func (m OutboxModel) pending(ctx context.Context, conn *sql.Conn, limit int) ([]pendingEvent, error) {
+	query := `
+		SELECT id, event, link_id, created_at, payload, published_to
+		FROM outbox
+		ORDER BY id ASC
+		LIMIT $1
+	`
+
+	rows, err := conn.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	events := []pendingEvent{}
+
+	for rows.Next() {
+		var event pendingEvent
+
+		err := rows.Scan(
+			&event.ID,
+			&event.Type,
+			&event.LinkID,
+			&event.CreatedAt,
+			&event.Data,
+			pq.Array(&event.publishedTo),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// retentionCutoff is a SQL expression for the point in time before which raw visits may be
+// dropped, given a retention period in days as $1. Visits which have not been rolled up yet are
+// never dropped, so the analytics totals are unaffected by the retention policy.
+const retentionCutoff = `
+	LEAST(
+		now() - make_interval(days => $1),
+		COALESCE((SELECT rolled_up_until FROM visit_rollup_state), '-infinity')
+	)`
+
+// CreatePartitions makes sure that a monthly partition of the visits table exists for the
+// current month and each of the following ahead months. It returns the names of the partitions
+// it created.
+func (m VisitModel) CreatePartitions(ahead int) ([]string, error) {
+	// Work out the partition bounds in the database so they match the partitions created by the
+	// migrations, which are aligned to months in the database's time zone.
+	query := `
+		SELECT 'visits_' || to_char(month, 'YYYY_MM'), month::text, (month + interval '1 month')::text
+		FROM generate_series(
+			date_trunc('month', now()),
+			date_trunc('month', now()) + make_interval(months => $1),
+			interval '1 month'
+		) AS month
+		WHERE to_regclass('visits_' || to_char(month, 'YYYY_MM')) IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ahead)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	type partition struct {
+		name, from, to string
+	}
+
+	missing := []partition{}
+
+	for rows.Next() {
+		var p partition
+
+		if err := rows.Scan(&p.name, &p.from, &p.to); err != nil {
+			return nil, err
+		}
+
+		missing = append(missing, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	partitions := []string{}
+
+	for _, p := range missing {
+		created, err := m.createPartition(p.name, p.from, p.to)
+		if err != nil {
+			return partitions, err
+		}
+
+		if created {
+			partitions = append(partitions, p.name)
+		}
+	}
+
+	return partitions, nil
+}
+
+// createPartition creates a monthly partition of the visits table. A partition can't be created
+// while the default partition holds visits in its range, so any such visits are moved into the
+// new table before it is attached as a partition. It reports whether the partition was created, as
+// another instance may have created it first.
+func (m VisitModel) createPartition(name, from, to string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Block inserts into the default partition until the new partition is attached, as attaching
+	// fails if any visits in its range are left in the default partition. This also serialises
+	// instances creating the same partition, so check it still doesn't exist once locked.
+	_, err = tx.ExecContext(ctx, `LOCK TABLE visits_default IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+
+	err = tx.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	table := pq.QuoteIdentifier(name)
+
+	statements := []string{
+		// The new table copies the default partition's columns, so that rows can be moved across
+		// with SELECT *, whatever order the columns were added in.
+		fmt.Sprintf(`CREATE TABLE %s (LIKE visits_default INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, table),
+
+		fmt.Sprintf(`
+			WITH moved AS (
+				DELETE FROM visits_default
+				WHERE created_at >= %[2]s AND created_at < %[3]s
+				RETURNING *
+			)
+			INSERT INTO %[1]s SELECT * FROM moved
+		`, table, pq.QuoteLiteral(from), pq.QuoteLiteral(to)),
+
+		fmt.Sprintf(
+			`ALTER TABLE visits ATTACH PARTITION %s FOR VALUES FROM (%s) TO (%s)`,
+			table, pq.QuoteLiteral(from), pq.QuoteLiteral(to),
+		),
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DropExpiredPartitions drops the monthly partitions of the visits table which only hold visits
+// older than the retention period, and deletes any such visits from the default partition. It
+// returns the names of the partitions it dropped.
+func (m VisitModel) DropExpiredPartitions(retentionDays int) ([]string, error) {
+	query := fmt.Sprintf(`
+		SELECT child.relname
+		FROM pg_inherits
+		INNER JOIN pg_class AS child ON child.oid = pg_inherits.inhrelid
+		WHERE pg_inherits.inhparent = 'visits'::regclass
+		AND child.relname ~ '^visits_[0-9]{4}_[0-9]{2}$'
+		AND to_timestamp(substr(child.relname, 8), 'YYYY_MM') + interval '1 month' <= %s
+		ORDER BY child.relname
+	`, retentionCutoff)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, retentionDays)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	partitions := []string{}
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		partitions = append(partitions, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range partitions {
+		if _, err := m.DB.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	query = fmt.Sprintf(`DELETE FROM visits_default WHERE created_at < %s`, retentionCutoff)
+
+	if _, err := m.DB.ExecContext(ctx, query, retentionDays); err != nil {
+		return nil, err
+	}
+
+	return partitions, nil
+}
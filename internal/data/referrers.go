@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/matthewsaunders/link-shortener-api/internal/referrer"
+)
+
+type ReferrerCount struct {
+	Host       string  `json:"host"`
+	Visits     int     `json:"visits"`
+	Percentage float64 `json:"percentage"`
+}
+
+// referrerHostBatch is the number of visits whose referrer host is filled in per transaction by
+// BackfillReferrerHosts.
+const referrerHostBatch = 1000
+
+// GetTopReferrers returns the referrer hosts which sent the most visits to a link between the
+// from and to days (inclusive), along with the share of all visits in that range each host sent.
+// Visits by bots are only counted when includeBots is true.
+func (m VisitModel) GetTopReferrers(link *Link, from, to time.Time, includeBots bool, limit int) ([]*ReferrerCount, int, error) {
+	// Visits recorded before referrer hosts were stored have no host until BackfillReferrerHosts
+	// has run, so their referrers are normalised here instead.
+	query := `
+		SELECT referrer_host, CASE WHEN referrer_host IS NULL THEN COALESCE(referrer, '') END, count(*)
+		FROM visits
+		WHERE visits.link_id = $1
+		AND (visits.is_bot = FALSE OR $2)
+		AND created_at >= CAST($3 as DATE)
+		AND created_at < CAST($4 as DATE) + 1
+		GROUP BY 1, 2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{link.ID, includeBots, from.Format(layoutISO), to.Format(layoutISO)}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	totalVisits := 0
+	counts := map[string]*ReferrerCount{}
+
+	for rows.Next() {
+		var host, rawReferrer sql.NullString
+		var visits int
+
+		if err := rows.Scan(&host, &rawReferrer, &visits); err != nil {
+			return nil, 0, err
+		}
+
+		if !host.Valid {
+			host.String = referrer.Host(rawReferrer.String)
+		}
+
+		if counts[host.String] == nil {
+			counts[host.String] = &ReferrerCount{Host: host.String}
+		}
+
+		counts[host.String].Visits += visits
+		totalVisits += visits
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	referrers := make([]*ReferrerCount, 0, len(counts))
+	for _, count := range counts {
+		referrers = append(referrers, count)
+	}
+
+	sort.Slice(referrers, func(i, j int) bool {
+		if referrers[i].Visits != referrers[j].Visits {
+			return referrers[i].Visits > referrers[j].Visits
+		}
+		return referrers[i].Host < referrers[j].Host
+	})
+
+	if len(referrers) > limit {
+		referrers = referrers[:limit]
+	}
+
+	for _, referrer := range referrers {
+		percentage := float64(referrer.Visits) / float64(totalVisits) * 100
+		referrer.Percentage = math.Round(percentage*100) / 100
+	}
+
+	return referrers, totalVisits, nil
+}
+
+// BackfillReferrerHosts fills in the referrer host of the visits recorded before referrer hosts
+// were stored, a batch at a time. It returns the number of visits updated.
+func (m VisitModel) BackfillReferrerHosts() (int64, error) {
+	var updated int64
+	after := uuid.Nil
+
+	for {
+		n, last, err := m.backfillReferrerHostBatch(after)
+		updated += n
+
+		if err != nil || n < referrerHostBatch {
+			return updated, err
+		}
+
+		after = last
+	}
+}
+
+// backfillReferrerHostBatch fills in the referrer hosts of the next batch of visits without one
+// after the visit ID after. It returns the number of visits updated and the last one's ID.
+func (m VisitModel) backfillReferrerHostBatch(after uuid.UUID) (int64, uuid.UUID, error) {
+	query := `
+		SELECT id, COALESCE(referrer, '')
+		FROM visits
+		WHERE referrer_host IS NULL AND id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, referrerHostBatch)
+	if err != nil {
+		return 0, after, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	ids := []string{}
+	hosts := []string{}
+
+	for rows.Next() {
+		var id uuid.UUID
+		var rawReferrer string
+
+		if err := rows.Scan(&id, &rawReferrer); err != nil {
+			return 0, after, err
+		}
+
+		ids = append(ids, id.String())
+		hosts = append(hosts, referrer.Host(rawReferrer))
+		after = id
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, after, err
+	}
+
+	if len(ids) == 0 {
+		return 0, after, nil
+	}
+
+	query = `
+		UPDATE visits
+		SET referrer_host = backfill.host
+		FROM unnest($1::uuid[], $2::text[]) AS backfill(id, host)
+		WHERE visits.id = backfill.id AND visits.referrer_host IS NULL
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(hosts)); err != nil {
+		return 0, after, err
+	}
+
+	return int64(len(ids)), after, nil
+}
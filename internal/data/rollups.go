@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// rollupLag is how far behind the current time the rollup watermark trails. An hour is only
+// folded into the rollup tables once it has been closed for at least this long, so that visits
+// still being inserted around the hour boundary are not skipped.
+const rollupLag = 5 * time.Minute
+
+// rollupChunk is the span of visits folded into the rollup tables in each transaction, so that
+// catching up on a long backlog, such as on the first run or a backfill, is done a bounded amount
+// at a time rather than in one transaction over the whole visits table.
+const rollupChunk = 24 * time.Hour
+
+// RollUp folds all visits between the current watermark and the last closed hour into the
+// hourly and daily rollup tables, and then advances the watermark. It returns the new watermark.
+func (m VisitModel) RollUp() (time.Time, error) {
+	for {
+		until, done, err := m.rollUpChunk()
+		if err != nil || done {
+			return until, err
+		}
+	}
+}
+
+// Backfill discards the contents of the rollup tables and rebuilds them from every visit up
+// to the last closed hour. It returns the new watermark. While the rollups are rebuilt the
+// visits which haven't been folded in yet are read from the visits table, so the analytics stay
+// complete throughout.
+func (m VisitModel) Backfill() (time.Time, error) {
+	if err := m.ResetRollups(); err != nil {
+		return time.Time{}, err
+	}
+
+	return m.RollUp()
+}
+
+// ResetRollups discards the contents of the rollup tables and clears the watermark, so that
+// every visit is read from the visits table until RollUp folds them in again. Backdated visits
+// can only be seeded while nothing is rolled up, see Seed.
+func (m VisitModel) ResetRollups() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, "SELECT rolled_up_until FROM visit_rollup_state FOR UPDATE")
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"visits_hourly", "visits_daily", "visits_daily_variants"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE visit_rollup_state SET rolled_up_until = NULL")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rollUpChunk folds up to rollupChunk of visits after the watermark into the rollup tables and
+// advances the watermark past them. It returns the new watermark and whether it has reached the
+// last closed hour.
+func (m VisitModel) rollUpChunk() (time.Time, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Lock the watermark row so that concurrent rollups (e.g. several API instances, or the
+	// backfill command) cannot fold the same range of visits in twice.
+	var watermark sql.NullTime
+	var closed time.Time
+
+	query := `
+		SELECT rolled_up_until, date_trunc('hour', now() - make_interval(secs => $1))
+		FROM visit_rollup_state
+		FOR UPDATE
+	`
+
+	err = tx.QueryRowContext(ctx, query, rollupLag.Seconds()).Scan(&watermark, &closed)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	from := watermark.Time
+
+	// Without a watermark nothing has been rolled up yet, so start from the first visit.
+	if !watermark.Valid {
+		var first sql.NullTime
+
+		query := `SELECT date_trunc('hour', min(created_at)) FROM visits WHERE created_at < $1`
+
+		err = tx.QueryRowContext(ctx, query, closed).Scan(&first)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		from = closed
+		if first.Valid {
+			from = first.Time
+		}
+	}
+
+	if !from.Before(closed) {
+		if !watermark.Valid {
+			_, err = tx.ExecContext(ctx, "UPDATE visit_rollup_state SET rolled_up_until = $1", closed)
+			if err != nil {
+				return time.Time{}, false, err
+			}
+
+			if err := tx.Commit(); err != nil {
+				return time.Time{}, false, err
+			}
+		}
+
+		return from, true, nil
+	}
+
+	until := from.Add(rollupChunk)
+	if until.After(closed) {
+		until = closed
+	}
+
+	// The visits of deleted links are left in the visits table, but their rollups went with them.
+	queries := []string{
+		`
+		INSERT INTO visits_hourly (link_id, bucket, is_bot, visits)
+		SELECT link_id, date_trunc('hour', created_at), is_bot, count(*)
+		FROM visits
+		WHERE created_at >= $1 AND created_at < $2
+		AND link_id IN (SELECT id FROM links)
+		GROUP BY 1, 2, 3
+		ON CONFLICT (link_id, bucket, is_bot) DO UPDATE SET visits = visits_hourly.visits + EXCLUDED.visits
+		`,
+		`
+		INSERT INTO visits_daily (link_id, bucket, is_bot, visits)
+		SELECT link_id, CAST(created_at as DATE), is_bot, count(*)
+		FROM visits
+		WHERE created_at >= $1 AND created_at < $2
+		AND link_id IN (SELECT id FROM links)
+		GROUP BY 1, 2, 3
+		ON CONFLICT (link_id, bucket, is_bot) DO UPDATE SET visits = visits_daily.visits + EXCLUDED.visits
+		`,
+		`
+		INSERT INTO visits_daily_variants (link_id, variant_id, bucket, is_bot, visits)
+		SELECT link_id, variant_id, CAST(created_at as DATE), is_bot, count(*)
+		FROM visits
+		WHERE created_at >= $1 AND created_at < $2
+		AND link_id IN (SELECT id FROM links)
+		AND variant_id IS NOT NULL
+		GROUP BY 1, 2, 3, 4
+		ON CONFLICT (link_id, variant_id, bucket, is_bot)
+		DO UPDATE SET visits = visits_daily_variants.visits + EXCLUDED.visits
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, from, until); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	err = m.rollUpVisitors(ctx, tx, from, until)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE visit_rollup_state SET rolled_up_until = $1", until)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, false, err
+	}
+
+	return until, !until.Before(closed), nil
+}
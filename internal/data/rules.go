@@ -0,0 +1,363 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/matthewsaunders/link-shortener-api/internal/useragent"
+	"github.com/matthewsaunders/link-shortener-api/internal/validator"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// CountryRX matches ISO 3166-1 alpha-2 country codes.
+	CountryRX = regexp.MustCompile("^[A-Z]{2}$")
+
+	// LanguageRX matches language tags such as "en" or "en-GB".
+	LanguageRX = regexp.MustCompile("^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$")
+)
+
+// LinkRule redirects visits matching all of its conditions to a different destination than the
+// link's. Empty conditions match any visit. The rules of a link are evaluated in order of their
+// position, and the first matching rule wins.
+type LinkRule struct {
+	ID               uuid.UUID  `json:"id"`
+	LinkID           uuid.UUID  `json:"link_id"`
+	Position         int        `json:"position"`
+	Destination      string     `json:"destination"`
+	Countries        []string   `json:"countries"`
+	Devices          []string   `json:"devices"`
+	OperatingSystems []string   `json:"operating_systems"`
+	Languages        []string   `json:"languages"`
+	StartsAt         *time.Time `json:"starts_at"`
+	EndsAt           *time.Time `json:"ends_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"-"`
+	Version          int32      `json:"version"`
+}
+
+// RuleContext holds the details of a visit which rules are matched against.
+type RuleContext struct {
+	Country   string
+	Device    string
+	OS        string
+	Languages []string
+	Time      time.Time
+}
+
+// Matches reports whether a visit matches all the conditions of the rule.
+func (rule *LinkRule) Matches(visit RuleContext) bool {
+	if rule.StartsAt != nil && visit.Time.Before(*rule.StartsAt) {
+		return false
+	}
+
+	if rule.EndsAt != nil && !visit.Time.Before(*rule.EndsAt) {
+		return false
+	}
+
+	if len(rule.Countries) > 0 && !containsFold(rule.Countries, visit.Country) {
+		return false
+	}
+
+	if len(rule.Devices) > 0 && !containsFold(rule.Devices, visit.Device) {
+		return false
+	}
+
+	if len(rule.OperatingSystems) > 0 && !containsFold(rule.OperatingSystems, visit.OS) {
+		return false
+	}
+
+	if len(rule.Languages) > 0 && !matchesLanguage(rule.Languages, visit.Languages) {
+		return false
+	}
+
+	return true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLanguage reports whether any of the visitor's languages match a rule language. A rule
+// language without a region (e.g. "en") matches every region of that language (e.g. "en-GB").
+func matchesLanguage(ruleLanguages, visitorLanguages []string) bool {
+	for _, visitor := range visitorLanguages {
+		for _, rule := range ruleLanguages {
+			if strings.EqualFold(visitor, rule) || strings.HasPrefix(strings.ToLower(visitor), strings.ToLower(rule)+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchRule returns the first of the ordered rules which matches a visit, or nil if none do.
+func MatchRule(rules []*LinkRule, visit RuleContext) *LinkRule {
+	for _, rule := range rules {
+		if rule.Matches(visit) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func ValidateLinkRule(v *validator.Validator, rule *LinkRule) {
+	v.Check(rule.Position >= 0, "position", "must not be negative")
+
+	v.Check(rule.Destination != "", "destination", "must be provided")
+	if rule.Destination != "" {
+		u, err := url.Parse(rule.Destination)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "destination", "must be an absolute http or https URL")
+	}
+
+	for _, country := range rule.Countries {
+		v.Check(validator.Matches(country, CountryRX), "countries", "must only contain ISO 3166-1 alpha-2 country codes")
+	}
+
+	for _, device := range rule.Devices {
+		v.Check(validator.In(device, useragent.Devices...), "devices", "must only contain "+strings.Join(useragent.Devices, ", "))
+	}
+
+	for _, os := range rule.OperatingSystems {
+		v.Check(validator.In(os, useragent.OperatingSystems...), "operating_systems", "must only contain "+strings.Join(useragent.OperatingSystems, ", "))
+	}
+
+	for _, language := range rule.Languages {
+		v.Check(validator.Matches(language, LanguageRX), "languages", "must only contain language tags such as en or en-GB")
+	}
+
+	v.Check(validator.Unique(rule.Countries), "countries", "must not contain duplicate values")
+	v.Check(validator.Unique(rule.Devices), "devices", "must not contain duplicate values")
+	v.Check(validator.Unique(rule.OperatingSystems), "operating_systems", "must not contain duplicate values")
+	v.Check(validator.Unique(rule.Languages), "languages", "must not contain duplicate values")
+
+	if rule.StartsAt != nil && rule.EndsAt != nil {
+		v.Check(rule.EndsAt.After(*rule.StartsAt), "ends_at", "must be after starts_at")
+	}
+}
+
+type LinkRuleModel struct {
+	DB       *sql.DB
+	InfoLog  *zerolog.Logger
+	ErrorLog *zerolog.Logger
+}
+
+// Insert adds a rule to a link. If last is true, the rule is placed after the link's existing
+// rules, and otherwise at its position.
+func (m LinkRuleModel) Insert(rule *LinkRule, last bool) error {
+	query := `
+		INSERT INTO link_rules (link_id, position, destination, countries, devices, operating_systems,
+			languages, starts_at, ends_at)
+		VALUES (
+			$1,
+			CASE WHEN $10 THEN (SELECT COALESCE(max(position), 0) + 1 FROM link_rules WHERE link_id = $1) ELSE $2 END,
+			$3,
+			COALESCE($4::text[], '{}'),
+			COALESCE($5::text[], '{}'),
+			COALESCE($6::text[], '{}'),
+			COALESCE($7::text[], '{}'),
+			$8,
+			$9
+		)
+		RETURNING id, position, created_at, version
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		rule.LinkID,
+		rule.Position,
+		rule.Destination,
+		pq.Array(rule.Countries),
+		pq.Array(rule.Devices),
+		pq.Array(rule.OperatingSystems),
+		pq.Array(rule.Languages),
+		rule.StartsAt,
+		rule.EndsAt,
+		last,
+	}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&rule.ID, &rule.Position, &rule.CreatedAt, &rule.Version)
+}
+
+func (m LinkRuleModel) Get(linkID, id uuid.UUID) (*LinkRule, error) {
+	query := `
+		SELECT id, link_id, position, destination, countries, devices, operating_systems, languages,
+			starts_at, ends_at, created_at, updated_at, version
+		FROM link_rules
+		WHERE link_id = $1 AND id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rule, err := scanLinkRule(m.DB.QueryRowContext(ctx, query, linkID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// GetAllForLink returns the rules of a link in the order they are evaluated.
+func (m LinkRuleModel) GetAllForLink(linkID uuid.UUID) ([]*LinkRule, error) {
+	query := `
+		SELECT id, link_id, position, destination, countries, devices, operating_systems, languages,
+			starts_at, ends_at, created_at, updated_at, version
+		FROM link_rules
+		WHERE link_id = $1
+		ORDER BY position ASC, created_at ASC, id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	rules := []*LinkRule{}
+
+	for rows.Next() {
+		rule, err := scanLinkRule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (m LinkRuleModel) Update(rule *LinkRule) error {
+	query := `
+		UPDATE link_rules
+		SET position = $1,
+			destination = $2,
+			countries = COALESCE($3::text[], '{}'),
+			devices = COALESCE($4::text[], '{}'),
+			operating_systems = COALESCE($5::text[], '{}'),
+			languages = COALESCE($6::text[], '{}'),
+			starts_at = $7,
+			ends_at = $8,
+			updated_at = NOW(),
+			version = version + 1
+		WHERE id = $9 AND link_id = $10 AND version = $11
+		RETURNING version
+	`
+
+	args := []interface{}{
+		rule.Position,
+		rule.Destination,
+		pq.Array(rule.Countries),
+		pq.Array(rule.Devices),
+		pq.Array(rule.OperatingSystems),
+		pq.Array(rule.Languages),
+		rule.StartsAt,
+		rule.EndsAt,
+		rule.ID,
+		rule.LinkID,
+		rule.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&rule.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m LinkRuleModel) Delete(linkID, id uuid.UUID) error {
+	query := `
+		DELETE FROM link_rules
+		WHERE link_id = $1 AND id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, linkID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLinkRule(row rowScanner) (*LinkRule, error) {
+	var rule LinkRule
+
+	err := row.Scan(
+		&rule.ID,
+		&rule.LinkID,
+		&rule.Position,
+		&rule.Destination,
+		pq.Array(&rule.Countries),
+		pq.Array(&rule.Devices),
+		pq.Array(&rule.OperatingSystems),
+		pq.Array(&rule.Languages),
+		&rule.StartsAt,
+		&rule.EndsAt,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+		&rule.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
@@ -0,0 +1,424 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matthewsaunders/link-shortener-api/internal/hll"
+)
+
+// saltRefreshInterval is how long a visitor salt is cached for before checking whether the day
+// has rolled over.
+const saltRefreshInterval = time.Minute
+
+// saltCache caches the visitor salt of the current day, so that hashing a visitor does not need
+// a database round trip.
+type saltCache struct {
+	mu        sync.Mutex
+	salt      []byte
+	fetchedAt time.Time
+}
+
+// VisitorHash returns a hash identifying a visitor by their IP address and user agent. The hash
+// is keyed with a random salt which changes every day, so the same visitor hashes differently
+// on different days and the hash cannot be reversed once the salt has been deleted.
+func (m VisitModel) VisitorHash(ip, userAgent string) (int64, error) {
+	salt, err := m.visitorSalt()
+	if err != nil {
+		return 0, err
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil))), nil
+}
+
+func (m VisitModel) visitorSalt() ([]byte, error) {
+	m.salts.mu.Lock()
+	defer m.salts.mu.Unlock()
+
+	if m.salts.salt != nil && time.Since(m.salts.fetchedAt) < saltRefreshInterval {
+		return m.salts.salt, nil
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Another instance may have already created the salt for today, in which case theirs wins.
+	_, err := m.DB.ExecContext(ctx, `
+		INSERT INTO visitor_salts (day, salt)
+		VALUES (current_date, $1)
+		ON CONFLICT (day) DO NOTHING
+	`, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.QueryRowContext(ctx, `SELECT salt FROM visitor_salts WHERE day = current_date`).Scan(&salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM visitor_salts WHERE day < current_date`)
+	if err != nil {
+		return nil, err
+	}
+
+	m.salts.salt = salt
+	m.salts.fetchedAt = time.Now()
+
+	return salt, nil
+}
+
+// rollupVisitorBatch is how many links' visitor sketches are built and merged at a time, which
+// bounds the memory used by a rollup however many visits it covers.
+const rollupVisitorBatch = 100
+
+// rollUpVisitors merges the visitor hashes of the visits in the given range into the HyperLogLog
+// sketches of the hourly and daily rollup tables. The rollup rows must already exist. Links are
+// worked through in batches, so only the sketches of one batch are held at a time.
+func (m VisitModel) rollUpVisitors(ctx context.Context, tx *sql.Tx, from, until time.Time) error {
+	after := ""
+
+	for {
+		linkIDs, err := m.rollupLinkBatch(ctx, tx, from, until, after)
+		if err != nil || len(linkIDs) == 0 {
+			return err
+		}
+
+		hourly, daily, err := m.buildSketches(ctx, tx, from, until, linkIDs)
+		if err != nil {
+			return err
+		}
+
+		if err := mergeSketches(ctx, tx, "visits_hourly", "timestamptz", hourly); err != nil {
+			return err
+		}
+
+		if err := mergeSketches(ctx, tx, "visits_daily", "date", daily); err != nil {
+			return err
+		}
+
+		after = linkIDs[len(linkIDs)-1]
+	}
+}
+
+// rollupLinkBatch returns the next batch of links, after the given one, which have visitor hashes
+// in the range.
+func (m VisitModel) rollupLinkBatch(ctx context.Context, tx *sql.Tx, from, until time.Time, after string) ([]string, error) {
+	query := `
+		SELECT DISTINCT link_id::text
+		FROM visits
+		WHERE created_at >= $1 AND created_at < $2
+		AND visitor_hash IS NOT NULL
+		AND ($3 = '' OR link_id > $3::uuid)
+		ORDER BY 1
+		LIMIT $4
+	`
+
+	rows, err := tx.QueryContext(ctx, query, from, until, after, rollupVisitorBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	linkIDs := []string{}
+
+	for rows.Next() {
+		var linkID string
+
+		if err := rows.Scan(&linkID); err != nil {
+			return nil, err
+		}
+
+		linkIDs = append(linkIDs, linkID)
+	}
+
+	return linkIDs, rows.Err()
+}
+
+// buildSketches returns the hourly and daily sketches of the visitor hashes of the given links'
+// visits in the range.
+func (m VisitModel) buildSketches(ctx context.Context, tx *sql.Tx, from, until time.Time, linkIDs []string) (map[rollupKey]*hll.Sketch, map[rollupKey]*hll.Sketch, error) {
+	query := `
+		SELECT link_id::text, date_trunc('hour', created_at)::text, CAST(created_at as DATE)::text,
+			is_bot, visitor_hash
+		FROM visits
+		WHERE created_at >= $1 AND created_at < $2
+		AND visitor_hash IS NOT NULL
+		AND link_id = ANY($3::uuid[])
+	`
+
+	rows, err := tx.QueryContext(ctx, query, from, until, pq.Array(linkIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	hourly := map[rollupKey]*hll.Sketch{}
+	daily := map[rollupKey]*hll.Sketch{}
+
+	for rows.Next() {
+		var linkID, hour, day string
+		var isBot bool
+		var hash int64
+
+		if err := rows.Scan(&linkID, &hour, &day, &isBot, &hash); err != nil {
+			return nil, nil, err
+		}
+
+		addToSketch(hourly, rollupKey{linkID, hour, isBot}, hash)
+		addToSketch(daily, rollupKey{linkID, day, isBot}, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return hourly, daily, nil
+}
+
+func addToSketch[K comparable](sketches map[K]*hll.Sketch, key K, hash int64) {
+	sketch, ok := sketches[key]
+	if !ok {
+		sketch = hll.New()
+		sketches[key] = sketch
+	}
+
+	sketch.Add(uint64(hash))
+}
+
+// rollupKey identifies a row of the rollup tables.
+type rollupKey struct {
+	linkID string
+	bucket string
+	isBot  bool
+}
+
+// mergeSketches merges sketches into the visitors column of the matching rows of a rollup table,
+// whose buckets are of the given SQL type. The existing sketches are read and the merged ones
+// written back with a single statement each.
+func mergeSketches(ctx context.Context, tx *sql.Tx, table, bucketType string, sketches map[rollupKey]*hll.Sketch) error {
+	if len(sketches) == 0 {
+		return nil
+	}
+
+	linkIDs := make([]string, 0, len(sketches))
+	buckets := make([]string, 0, len(sketches))
+	isBots := make([]bool, 0, len(sketches))
+
+	for key := range sketches {
+		linkIDs = append(linkIDs, key.linkID)
+		buckets = append(buckets, key.bucket)
+		isBots = append(isBots, key.isBot)
+	}
+
+	query := `
+		SELECT t.link_id::text, t.bucket::text, t.is_bot, t.visitors
+		FROM ` + table + ` t
+		JOIN unnest($1::uuid[], $2::` + bucketType + `[], $3::boolean[]) AS k(link_id, bucket, is_bot)
+			ON t.link_id = k.link_id AND t.bucket = k.bucket AND t.is_bot = k.is_bot
+		WHERE t.visitors IS NOT NULL
+	`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(linkIDs), pq.Array(buckets), pq.Array(isBots))
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var key rollupKey
+		var existing []byte
+
+		if err := rows.Scan(&key.linkID, &key.bucket, &key.isBot, &existing); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		previous := &hll.Sketch{}
+		if err := previous.UnmarshalBinary(existing); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		if sketch, ok := sketches[key]; ok {
+			sketch.Merge(previous)
+		}
+	}
+
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	encoded := make([][]byte, len(linkIDs))
+	for i := range linkIDs {
+		encoded[i], err = sketches[rollupKey{linkIDs[i], buckets[i], isBots[i]}].MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `
+		UPDATE ` + table + ` t
+		SET visitors = k.visitors
+		FROM unnest($1::uuid[], $2::` + bucketType + `[], $3::boolean[], $4::bytea[])
+			AS k(link_id, bucket, is_bot, visitors)
+		WHERE t.link_id = k.link_id AND t.bucket = k.bucket AND t.is_bot = k.is_bot
+	`
+
+	_, err = tx.ExecContext(ctx, query, pq.Array(linkIDs), pq.Array(buckets), pq.Array(isBots), pq.Array(encoded))
+	return err
+}
+
+// getUniqueVisitors estimates the unique visitors of a link overall and for each of the
+// aggregated days, by merging the daily sketches with the hashes of the un-rolled visits. The
+// visitor hashes of different days never match, as their salts differ, so the overall estimate
+// is the sum of the daily ones.
+func (m VisitModel) getUniqueVisitors(link *Link, includeBots bool, data *VisitData) error {
+	days, err := m.getDailySketches(link, includeBots)
+	if err != nil {
+		return err
+	}
+
+	err = m.addUnrolledVisitors(link, includeBots, days)
+	if err != nil {
+		return err
+	}
+
+	total := hll.New()
+	for _, sketch := range days {
+		total.Merge(sketch)
+	}
+
+	data.UniqueVisitors = int(total.Count())
+
+	for _, bucket := range data.AggregatedVists {
+		if sketch, ok := days[bucket.Date]; ok {
+			bucket.UniqueVisitors = int(sketch.Count())
+		}
+	}
+
+	return nil
+}
+
+// getDailySketches returns the rolled up visitor sketches of a link keyed by day. The sketches of
+// bot and human visitors are merged when bots are included.
+func (m VisitModel) getDailySketches(link *Link, includeBots bool) (map[string]*hll.Sketch, error) {
+	query := `
+		SELECT bucket::text, visitors
+		FROM visits_daily
+		WHERE visits_daily.link_id = $1
+		AND (visits_daily.is_bot = FALSE OR $2)
+		AND visitors IS NOT NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, link.ID, includeBots)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	days := map[string]*hll.Sketch{}
+
+	for rows.Next() {
+		var day string
+		var encoded []byte
+
+		if err := rows.Scan(&day, &encoded); err != nil {
+			return nil, err
+		}
+
+		sketch := &hll.Sketch{}
+		if err := sketch.UnmarshalBinary(encoded); err != nil {
+			return nil, err
+		}
+
+		if existing, ok := days[day]; ok {
+			sketch.Merge(existing)
+		}
+
+		days[day] = sketch
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return days, nil
+}
+
+// addUnrolledVisitors adds the visitor hashes of a link's un-rolled visits to the sketches of
+// the days they were made on.
+func (m VisitModel) addUnrolledVisitors(link *Link, includeBots bool, days map[string]*hll.Sketch) error {
+	query := `
+		SELECT CAST(created_at as DATE)::text, visitor_hash
+		FROM visits
+		WHERE visits.link_id = $1
+		AND (visits.is_bot = FALSE OR $2)
+		AND visitor_hash IS NOT NULL
+		AND ` + unrolledVisits
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, link.ID, includeBots)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	for rows.Next() {
+		var day string
+		var hash int64
+
+		if err := rows.Scan(&day, &hash); err != nil {
+			return err
+		}
+
+		addToSketch(days, day, hash)
+	}
+
+	return rows.Err()
+}
@@ -5,70 +5,220 @@ import (
 	"database/sql"
 	"fmt"
 	"math"
+	"net"
 	"sort"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/referrer"
 	"github.com/matthewsaunders/link-shortener-api/internal/validator"
 	"github.com/rs/zerolog"
 )
 
 const layoutISO = "2006-01-02"
 
+// unrolledVisits is a SQL condition matching the visits which have not yet been folded into the
+// rollup tables.
+const unrolledVisits = `created_at >= COALESCE((SELECT rolled_up_until FROM visit_rollup_state), '-infinity')`
+
 type Visit struct {
-	ID         uuid.UUID `json:"id"`
-	LinkID     uuid.UUID `json:"link_id"`
-	CreatedAt  time.Time `json:"created_at"`
-	Referrer   string    `json:"referrer"`
-	RemoteAddr string    `json:remote_address`
+	ID             uuid.UUID  `json:"id"`
+	LinkID         uuid.UUID  `json:"link_id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Referrer       string     `json:"referrer"`
+	ReferrerHost   string     `json:"referrer_host"`
+	RemoteAddr     string     `json:"remote_address"`
+	UserAgent      string     `json:"user_agent"`
+	Browser        string     `json:"browser"`
+	BrowserVersion string     `json:"browser_version"`
+	OS             string     `json:"os"`
+	Device         string     `json:"device"`
+	Country        string     `json:"country"`
+	Region         string     `json:"region"`
+	City           string     `json:"city"`
+	Source         string     `json:"source"`
+	RuleID         *uuid.UUID `json:"rule_id"`
+	VariantID      *uuid.UUID `json:"variant_id"`
+	IsBot          bool       `json:"is_bot"`
+	VisitorHash    int64      `json:"-"`
+}
+
+// IP privacy modes, controlling how visitor IP addresses are shown outside of the API, in visit
+// listings and streams as well as the events and webhooks sent about visits.
+const (
+	IPFull     = "full"
+	IPTruncate = "truncate"
+	IPHide     = "hide"
+)
+
+var IPPrivacyModes = []string{IPFull, IPTruncate, IPHide}
+
+// MaskIP masks an IP address according to an IP privacy mode. Truncated IPv4 addresses keep
+// their /24 network and IPv6 addresses their /48, which is enough to tell networks apart without
+// identifying individual visitors.
+func MaskIP(addr, mode string) string {
+	switch mode {
+	case IPFull:
+		return addr
+	case IPTruncate:
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return ""
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	default:
+		return ""
+	}
+}
+
+// Masked returns a copy of the visit with its IP address masked according to an IP privacy mode,
+// for sending outside of the API.
+func (v Visit) Masked(mode string) *Visit {
+	v.RemoteAddr = MaskIP(v.RemoteAddr, mode)
+	return &v
 }
 
 type AggregatedVists struct {
-	Date   string `json:"date"`
-	Visits int    `json:"visits"`
+	Date           string `json:"date"`
+	Visits         int    `json:"visits"`
+	UniqueVisitors int    `json:"unique_visitors"`
 }
 
 type VisitData struct {
-	TotalVisits     int                `json:"total_visits"`
+	TotalVisits int `json:"total_visits"`
+	// UniqueVisitors is the number of unique visitors of each day added up, as visitors are
+	// identified by a hash salted afresh every day. A visitor who comes back on another day is
+	// counted again.
+	UniqueVisitors  int                `json:"unique_visitors"`
 	SevenDayVisits  int                `json:"seven_day_visits"`
 	VisitsPerDay    float64            `json:"visits_per_day"`
 	AggregatedVists []*AggregatedVists `json:"visits"`
+	Variants        []*VariantVisits   `json:"variants"`
+	Conversions     int                `json:"conversions"`
+	ConversionRate  float64            `json:"conversion_rate"`
+	Goals           []*GoalConversions `json:"goals"`
 }
 
 type VisitModel struct {
 	DB       *sql.DB
 	InfoLog  *zerolog.Logger
 	ErrorLog *zerolog.Logger
+	salts    *saltCache
+
+	// IPPrivacy is the IP privacy mode visits are listed and published with.
+	IPPrivacy string
 }
 
 func (m VisitModel) Insert(visit *Visit) error {
 	query := `
-		INSERT INTO visits (link_id, referrer, remote_address)
-		VALUES ($1, $2, $3)
+		INSERT INTO visits (link_id, referrer, referrer_host, remote_address, user_agent, browser,
+			browser_version, os, device, country, region, city, source, rule_id, variant_id, is_bot,
+			visitor_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 		RETURNING id, created_at
 		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{visit.LinkID, visit.Referrer, visit.RemoteAddr}
+	args := []interface{}{
+		visit.LinkID,
+		visit.Referrer,
+		visit.ReferrerHost,
+		visit.RemoteAddr,
+		visit.UserAgent,
+		visit.Browser,
+		visit.BrowserVersion,
+		visit.OS,
+		visit.Device,
+		visit.Country,
+		visit.Region,
+		visit.City,
+		visit.Source,
+		visit.RuleID,
+		visit.VariantID,
+		visit.IsBot,
+		visit.VisitorHash,
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&visit.ID, &visit.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if !visit.IsBot {
+		if err := countVisit(ctx, tx, visit.LinkID, visit.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := insertOutboxEvent(ctx, tx, visit.LinkID, EventVisitCreated, visit.Masked(m.IPPrivacy)); err != nil {
+		return err
+	}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&visit.ID, &visit.CreatedAt)
+	return tx.Commit()
 }
 
+// Seed inserts a visit made at its CreatedAt. Visits from before the rollup watermark would
+// never be folded into the rollups, and so would be missing from the analytics, so they are
+// rejected with ErrBackdatedVisit. Reset the rollups before seeding such visits, and roll them up
+// again afterwards.
 func (m VisitModel) Seed(visit *Visit) error {
 	query := `
-		INSERT INTO visits (link_id, referrer, remote_address, created_at)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO visits (link_id, referrer, referrer_host, remote_address, created_at)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id
 		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{visit.LinkID, visit.Referrer, visit.RemoteAddr, visit.CreatedAt}
+	visit.ReferrerHost = referrer.Host(visit.Referrer)
+
+	args := []interface{}{visit.LinkID, visit.Referrer, visit.ReferrerHost, visit.RemoteAddr, visit.CreatedAt}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Hold the watermark until the visit is committed, so the rollup can't move past it meanwhile.
+	var watermark sql.NullTime
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&visit.ID)
+	err = tx.QueryRowContext(ctx, "SELECT rolled_up_until FROM visit_rollup_state FOR SHARE").Scan(&watermark)
+	if err != nil {
+		return err
+	}
+
+	if watermark.Valid && visit.CreatedAt.Before(watermark.Time) {
+		return ErrBackdatedVisit
+	}
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&visit.ID); err != nil {
+		return err
+	}
+
+	if err := countVisit(ctx, tx, visit.LinkID, visit.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (m VisitModel) printFormattedDate(date time.Time) string {
@@ -80,17 +230,28 @@ func (m VisitModel) parseFormattedDate(date string) time.Time {
 	return parsedTime
 }
 
-func (m VisitModel) getTotalCount(link *Link, data *VisitData) error {
+func (m VisitModel) getTotalCount(link *Link, includeBots bool, data *VisitData) error {
+	// Sum the rolled up daily counts and add on the visits which have not been rolled up yet.
 	query := fmt.Sprintf(`
-		SELECT count(*)
-		FROM visits
-		WHERE visits.link_id = $1
-	`)
+		SELECT
+			(
+				SELECT COALESCE(sum(visits), 0)
+				FROM visits_daily
+				WHERE visits_daily.link_id = $1
+				AND (visits_daily.is_bot = FALSE OR $2)
+			) + (
+				SELECT count(*)
+				FROM visits
+				WHERE visits.link_id = $1
+				AND (visits.is_bot = FALSE OR $2)
+				AND %s
+			)
+	`, unrolledVisits)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, link.ID).Scan(&data.TotalVisits)
+	err := m.DB.QueryRowContext(ctx, query, link.ID, includeBots).Scan(&data.TotalVisits)
 	if err != nil {
 		return err
 	}
@@ -98,7 +259,7 @@ func (m VisitModel) getTotalCount(link *Link, data *VisitData) error {
 	return nil
 }
 
-func (m VisitModel) getAggregatedCount(link *Link, data *VisitData) error {
+func (m VisitModel) getAggregatedCount(link *Link, includeBots bool, data *VisitData) error {
 	dateBuckets := make(map[string]int)
 	numDays := 7
 	date := time.Now()
@@ -112,19 +273,33 @@ func (m VisitModel) getAggregatedCount(link *Link, data *VisitData) error {
 		date = date.AddDate(0, 0, -1)
 	}
 
+	// Combine the daily rollups with the un-rolled tail of raw visits. The tail can overlap the
+	// last rolled up day, so the two sources are summed per day.
 	query := fmt.Sprintf(`
-		SELECT CAST(created_at as DATE), count(*)
-		FROM visits
-		WHERE visits.link_id = $1
-		AND created_at > now() - interval '1 week'
-		GROUP BY CAST(created_at as DATE)
-		ORDER BY CAST(created_at as DATE)
-	`)
+		SELECT day, sum(visits)
+		FROM (
+			SELECT bucket AS day, visits
+			FROM visits_daily
+			WHERE visits_daily.link_id = $1
+			AND (visits_daily.is_bot = FALSE OR $2)
+			AND bucket > CAST(now() - interval '1 week' as DATE)
+			UNION ALL
+			SELECT CAST(created_at as DATE), count(*)
+			FROM visits
+			WHERE visits.link_id = $1
+			AND (visits.is_bot = FALSE OR $2)
+			AND created_at > now() - interval '1 week'
+			AND %s
+			GROUP BY CAST(created_at as DATE)
+		) AS days
+		GROUP BY day
+		ORDER BY day
+	`, unrolledVisits)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{link.ID}
+	args := []interface{}{link.ID, includeBots}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -188,15 +363,32 @@ func (m *VisitModel) calculateVisitData(data *VisitData) error {
 	return nil
 }
 
-func (m VisitModel) GetData(link *Link) (*VisitData, error) {
+// GetData returns the visit analytics of a link. Visits by bots are only counted when
+// includeBots is true.
+func (m VisitModel) GetData(link *Link, includeBots bool) (*VisitData, error) {
 	data := &VisitData{}
 
-	err := m.getAggregatedCount(link, data)
+	err := m.getAggregatedCount(link, includeBots, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.getTotalCount(link, includeBots, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.getUniqueVisitors(link, includeBots, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.getVariantCounts(link, includeBots, data)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.getTotalCount(link, data)
+	err = m.getConversions(link, includeBots, data)
 	if err != nil {
 		return nil, err
 	}
@@ -209,6 +401,114 @@ func (m VisitModel) GetData(link *Link) (*VisitData, error) {
 	return data, nil
 }
 
+// VisitFilter narrows a listing of a link's visits. Zero fields match every visit.
+type VisitFilter struct {
+	// From and To bound the time of the visits, From inclusively and To exclusively.
+	From     time.Time
+	To       time.Time
+	Referrer string
+	Country  string
+	Device   string
+	IsBot    *bool
+}
+
+// GetAll returns the individual visits of a link which match filter, with their IP addresses
+// masked. Listings can only be sorted by time, as the other columns are nullable and can't be
+// paged through with a cursor.
+func (m VisitModel) GetAll(linkID uuid.UUID, filter VisitFilter, filters Filters) ([]*Visit, Metadata, error) {
+	page, pageArgs := filters.pageClauses("visits", 8, nil)
+
+	query := fmt.Sprintf(`
+		SELECT %s, %s, visits.id, link_id, created_at, COALESCE(referrer, ''),
+			COALESCE(referrer_host, ''), COALESCE(remote_address, ''), COALESCE(user_agent, ''),
+			COALESCE(browser, ''), COALESCE(browser_version, ''), COALESCE(os, ''),
+			COALESCE(device, ''), COALESCE(country, ''), COALESCE(region, ''), COALESCE(city, ''),
+			source, rule_id, variant_id, is_bot
+		FROM visits
+		WHERE link_id = $1
+		AND (created_at >= $2 OR $2 IS NULL)
+		AND (created_at < $3 OR $3 IS NULL)
+		AND (referrer_host = $4 OR $4 = '')
+		AND (country = $5 OR $5 = '')
+		AND (device = $6 OR $6 = '')
+		AND (is_bot = $7 OR $7 IS NULL)
+		AND %s
+		ORDER BY %s
+		%s`,
+		page.Count, page.SortKey, page.Where, page.OrderBy, page.Limit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var from, to *time.Time
+	if !filter.From.IsZero() {
+		from = &filter.From
+	}
+	if !filter.To.IsZero() {
+		to = &filter.To
+	}
+
+	args := []interface{}{linkID, from, to, filter.Referrer, filter.Country, filter.Device, filter.IsBot}
+	args = append(args, pageArgs...)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Error().Err(err).Msg("")
+		}
+	}()
+
+	totalRecords := 0
+	visits := []*Visit{}
+	keys := []cursorKey{}
+
+	for rows.Next() {
+		var visit Visit
+		var sortKey string
+
+		err := rows.Scan(
+			&totalRecords,
+			&sortKey,
+			&visit.ID,
+			&visit.LinkID,
+			&visit.CreatedAt,
+			&visit.Referrer,
+			&visit.ReferrerHost,
+			&visit.RemoteAddr,
+			&visit.UserAgent,
+			&visit.Browser,
+			&visit.BrowserVersion,
+			&visit.OS,
+			&visit.Device,
+			&visit.Country,
+			&visit.Region,
+			&visit.City,
+			&visit.Source,
+			&visit.RuleID,
+			&visit.VariantID,
+			&visit.IsBot,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		visits = append(visits, visit.Masked(m.IPPrivacy))
+		keys = append(keys, cursorKey{Value: sortKey, ID: visit.ID.String()})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.pageMetadata(totalRecords, keys)
+
+	return trimPage(visits, filters), metadata, nil
+}
+
 func ValidateVisit(v *validator.Validator, visit *Visit) {
 	// TODO
 }
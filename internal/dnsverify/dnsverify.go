@@ -0,0 +1,110 @@
+// Package dnsverify verifies ownership of custom domains with DNS TXT record challenges. The owner
+// of a domain proves control of it by publishing a TXT record holding the domain's verification
+// token under the challenge name.
+package dnsverify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// ChallengeLabel is the label the challenge record is published under, e.g.
+	// _shrtnr-challenge.go.example.com.
+	ChallengeLabel = "_shrtnr-challenge"
+
+	// valuePrefix prefixes the token in the challenge record's value.
+	valuePrefix = "shrtnr-verification="
+)
+
+var (
+	// ErrNoRecord is returned when the challenge name has no TXT records.
+	ErrNoRecord = errors.New("no TXT record found")
+
+	// ErrMismatch is returned when none of the challenge name's TXT records hold the token.
+	ErrMismatch = errors.New("TXT record does not match the verification token")
+)
+
+// Resolver looks up TXT records. It is satisfied by *net.Resolver, and by
+// dnsverifytest.Resolver in tests.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Challenge is the TXT record a domain's owner must publish to verify it.
+type Challenge struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// NewToken returns a random verification token.
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ChallengeFor returns the challenge record for a hostname and its verification token.
+func ChallengeFor(hostname, token string) Challenge {
+	return Challenge{
+		Type:  "TXT",
+		Name:  ChallengeLabel + "." + hostname,
+		Value: valuePrefix + token,
+	}
+}
+
+// Verify checks that the challenge record for hostname holds token. It returns ErrNoRecord or
+// ErrMismatch when the record is missing or wrong, and any other error when the lookup itself
+// failed and should be retried.
+func Verify(ctx context.Context, resolver Resolver, hostname, token string) error {
+	challenge := ChallengeFor(hostname, token)
+
+	records, err := resolver.LookupTXT(ctx, challenge.Name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrNoRecord
+		}
+		return fmt.Errorf("looking up %s: %w", challenge.Name, err)
+	}
+
+	if len(records) == 0 {
+		return ErrNoRecord
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == challenge.Value {
+			return nil
+		}
+	}
+
+	return ErrMismatch
+}
+
+// NewResolver returns a resolver which sends its queries to the DNS server at addr, e.g.
+// 1.1.1.1:53, or the system's resolver if addr is empty.
+func NewResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
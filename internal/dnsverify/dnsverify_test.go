@@ -0,0 +1,103 @@
+package dnsverify_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matthewsaunders/link-shortener-api/internal/dnsverify"
+	"github.com/matthewsaunders/link-shortener-api/internal/dnsverify/dnsverifytest"
+)
+
+const (
+	hostname = "go.example.com"
+	token    = "0123456789abcdef0123456789abcdef"
+)
+
+func TestVerify(t *testing.T) {
+	challenge := dnsverify.ChallengeFor(hostname, token)
+	transient := errors.New("i/o timeout")
+
+	tests := []struct {
+		name    string
+		setup   func(r *dnsverifytest.Resolver)
+		wantErr error
+	}{
+		{
+			name: "match",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT(challenge.Name, challenge.Value)
+			},
+		},
+		{
+			name: "match among other records",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT(challenge.Name, "v=spf1 -all", " "+challenge.Value+" ")
+			},
+		},
+		{
+			name: "match with a fully qualified name",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT("_SHRTNR-CHALLENGE.GO.EXAMPLE.COM.", challenge.Value)
+			},
+		},
+		{
+			name: "mismatch",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT(challenge.Name, dnsverify.ChallengeFor(hostname, "another-token").Value)
+			},
+			wantErr: dnsverify.ErrMismatch,
+		},
+		{
+			name: "record under another name",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT(hostname, challenge.Value)
+			},
+			wantErr: dnsverify.ErrNoRecord,
+		},
+		{
+			name:    "nxdomain",
+			setup:   func(r *dnsverifytest.Resolver) {},
+			wantErr: dnsverify.ErrNoRecord,
+		},
+		{
+			name: "transient error",
+			setup: func(r *dnsverifytest.Resolver) {
+				r.SetTXT(challenge.Name, challenge.Value)
+				r.SetError(transient)
+			},
+			wantErr: transient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := dnsverifytest.NewResolver()
+			tt.setup(resolver)
+
+			err := dnsverify.Verify(context.Background(), resolver, hostname, token)
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTransientErrorIsRetryable(t *testing.T) {
+	resolver := dnsverifytest.NewResolver()
+	resolver.SetError(errors.New("server misbehaving"))
+
+	err := dnsverify.Verify(context.Background(), resolver, hostname, token)
+
+	if err == nil || errors.Is(err, dnsverify.ErrNoRecord) || errors.Is(err, dnsverify.ErrMismatch) {
+		t.Fatalf("got error %v; want a lookup error", err)
+	}
+
+	resolver.SetError(nil)
+	resolver.SetTXT(dnsverify.ChallengeFor(hostname, token).Name, dnsverify.ChallengeFor(hostname, token).Value)
+
+	if err := dnsverify.Verify(context.Background(), resolver, hostname, token); err != nil {
+		t.Fatalf("got error %v once the resolver recovered; want nil", err)
+	}
+}
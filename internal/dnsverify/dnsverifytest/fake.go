@@ -0,0 +1,66 @@
+// Package dnsverifytest provides an in-process DNS resolver for testing domain verification.
+package dnsverifytest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Resolver is an in-process dnsverify.Resolver serving TXT records set on it, so that
+// verification can be exercised without real DNS.
+type Resolver struct {
+	mu      sync.Mutex
+	records map[string][]string
+	err     error
+}
+
+// NewResolver returns a resolver with no records.
+func NewResolver() *Resolver {
+	return &Resolver{records: map[string][]string{}}
+}
+
+// SetTXT sets the TXT records of a name, removing them if none are given.
+func (f *Resolver) SetTXT(name string, records ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = canonicalName(name)
+
+	if len(records) == 0 {
+		delete(f.records, name)
+		return
+	}
+
+	f.records[name] = records
+}
+
+// SetError makes every lookup fail with err, or succeed again if err is nil.
+func (f *Resolver) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+// LookupTXT returns the TXT records set for name, or a not found error if there are none.
+func (f *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	records, ok := f.records[canonicalName(name)]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return append([]string(nil), records...), nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,136 @@
+// Package geoip looks up the location of IP addresses in a local MaxMind format (MMDB) database,
+// such as GeoLite2 City. No external services are called.
+package geoip
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is the location of an IP address. Country is the ISO 3166-1 alpha-2 country code,
+// Region and City are English names. Fields missing from the database are left empty.
+type Location struct {
+	Country string
+	Region  string
+	City    string
+}
+
+// record is the subset of a GeoIP2/GeoLite2 City or Country record we decode.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// DB is a GeoIP database loaded from a file, which can be reloaded when the file changes. A nil
+// *DB is valid and finds no locations, which is used when no database has been configured.
+type DB struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// Open loads the database at path.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Reload loads the database file again if it has been modified since it was last loaded. It
+// reports whether the database was reloaded. Lookups keep using the previous database until the
+// new one has been loaded successfully.
+func (db *DB) Reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	unchanged := db.reader != nil && info.ModTime().Equal(db.modTime)
+	db.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	previous := db.reader
+	db.reader = reader
+	db.modTime = info.ModTime()
+	db.mu.Unlock()
+
+	if previous != nil {
+		return true, previous.Close()
+	}
+
+	return true, nil
+}
+
+// Lookup returns the location of an IP address. Addresses which are not in the database, such
+// as private addresses, have an empty location.
+func (db *DB) Lookup(ip string) (Location, error) {
+	if db == nil {
+		return Location{}, nil
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Location{}, errors.New("geoip: invalid ip address")
+	}
+
+	var rec record
+
+	db.mu.RLock()
+	err := db.reader.Lookup(parsed, &rec)
+	db.mu.RUnlock()
+
+	if err != nil {
+		return Location{}, err
+	}
+
+	location := Location{
+		Country: rec.Country.ISOCode,
+		City:    rec.City.Names["en"],
+	}
+
+	if len(rec.Subdivisions) > 0 {
+		location.Region = rec.Subdivisions[0].Names["en"]
+	}
+
+	return location, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.reader.Close()
+}
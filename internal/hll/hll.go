@@ -0,0 +1,148 @@
+// Package hll implements HyperLogLog sketches for estimating the number of distinct items in a
+// set. Sketches can be merged, so the sketches for several buckets can be combined into an
+// estimate for the union of those buckets.
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+const (
+	// precision is the number of hash bits used to pick a register. 2^12 registers give a
+	// standard error of roughly 1.6%.
+	precision = 12
+	registers = 1 << precision
+
+	version      = 1
+	formatDense  = 0
+	formatSparse = 1
+	headerLength = 3
+)
+
+// ErrInvalidSketch is returned when decoding a sketch which was not produced by MarshalBinary.
+var ErrInvalidSketch = errors.New("hll: invalid sketch")
+
+// Sketch is a HyperLogLog sketch. The zero value is not usable, use New instead.
+type Sketch struct {
+	registers []uint8
+}
+
+// New returns an empty sketch.
+func New() *Sketch {
+	return &Sketch{registers: make([]uint8, registers)}
+}
+
+// Add adds a 64-bit hash of an item to the sketch. The hash must be uniformly distributed.
+func (s *Sketch) Add(hash uint64) {
+	index := hash >> (64 - precision)
+
+	// Count the leading zeros of the remaining bits. The sentinel bit bounds the count for hashes
+	// whose remaining bits are all zero.
+	rank := uint8(bits.LeadingZeros64(hash<<precision|1<<(precision-1))) + 1
+
+	if rank > s.registers[index] {
+		s.registers[index] = rank
+	}
+}
+
+// Merge adds all items of other to the sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	for i, rank := range other.registers {
+		if rank > s.registers[i] {
+			s.registers[i] = rank
+		}
+	}
+}
+
+// Count returns the estimated number of distinct items added to the sketch.
+func (s *Sketch) Count() uint64 {
+	sum := 0.0
+	zeros := 0
+
+	for _, rank := range s.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Use linear counting for small cardinalities, where the raw estimate is heavily biased.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the sketch. Sketches with few populated registers are encoded sparsely
+// as (index, rank) pairs, which keeps the sketches of quiet buckets small.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	populated := 0
+	for _, rank := range s.registers {
+		if rank != 0 {
+			populated++
+		}
+	}
+
+	if populated*3 >= registers {
+		buf := make([]byte, headerLength, headerLength+registers)
+		buf[0], buf[1], buf[2] = version, precision, formatDense
+		return append(buf, s.registers...), nil
+	}
+
+	buf := make([]byte, headerLength, headerLength+populated*3)
+	buf[0], buf[1], buf[2] = version, precision, formatSparse
+
+	for i, rank := range s.registers {
+		if rank != 0 {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(i))
+			buf = append(buf, rank)
+		}
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded with MarshalBinary, replacing the contents of s.
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < headerLength || data[0] != version || data[1] != precision {
+		return ErrInvalidSketch
+	}
+
+	regs := make([]uint8, registers)
+	body := data[headerLength:]
+
+	switch data[2] {
+	case formatDense:
+		if len(body) != registers {
+			return ErrInvalidSketch
+		}
+		copy(regs, body)
+
+	case formatSparse:
+		if len(body)%3 != 0 {
+			return ErrInvalidSketch
+		}
+		for i := 0; i < len(body); i += 3 {
+			index := binary.BigEndian.Uint16(body[i:])
+			if int(index) >= registers {
+				return ErrInvalidSketch
+			}
+			regs[index] = body[i+2]
+		}
+
+	default:
+		return ErrInvalidSketch
+	}
+
+	s.registers = regs
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Package outbox defines the events relayed from the transactional outbox and the sinks they are
+// published to.
+//
+// Events are written to the outbox table in the same transaction as the change they describe, and
+// relayed to the sinks afterwards, so an event is never lost if the process dies after the change
+// is committed. Events may however be published more than once, so consumers should deduplicate
+// them by ID.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matthewsaunders/link-shortener-api/internal/webhook"
+)
+
+// Event is an event recorded in the outbox. IDs increase in the order events were recorded.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	LinkID    uuid.UUID       `json:"link_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Sink is somewhere events are published to. Publish must only return once the event has been
+// durably handed over, as the event is discarded from the outbox afterwards.
+type Sink interface {
+	Publish(ctx context.Context, event Event) error
+	Close() error
+}
+
+// Open opens the sink described by spec, which is one of
+//
+//	stdout          newline delimited JSON written to standard output
+//	file:<path>     newline delimited JSON appended to a file
+//	webhook:<url>   a signed POST request per event, see package webhook
+//
+// The secret signs the requests of webhook sinks, and is ignored by the others.
+func Open(spec, secret string, client *http.Client) (Sink, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	switch kind {
+	case "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("outbox: file sink requires a path")
+		}
+		return OpenFileSink(arg)
+	case "webhook":
+		if arg == "" {
+			return nil, fmt.Errorf("outbox: webhook sink requires a URL")
+		}
+		return &WebhookSink{URL: arg, Secret: secret, Client: client}, nil
+	default:
+		return nil, fmt.Errorf("outbox: unknown sink %q", spec)
+	}
+}
+
+// WriterSink writes events to a writer as newline delimited JSON.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Publish(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink appends events to a file as newline delimited JSON, syncing the file after every
+// event.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Publish(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// WebhookSink posts each event to a URL as a signed webhook request. The delivery ID is the event
+// ID, so the receiver can deduplicate events published more than once.
+type WebhookSink struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = webhook.Send(ctx, s.Client, webhook.Request{
+		URL:        s.URL,
+		Secret:     s.Secret,
+		Event:      event.Type,
+		DeliveryID: strconv.FormatInt(event.ID, 10),
+		Body:       body,
+	})
+	return err
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
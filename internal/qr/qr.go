@@ -0,0 +1,150 @@
+// Package qr renders QR codes as PNG images or SVG documents.
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Levels lists the error correction levels, from the least to the most redundant. Higher levels
+// survive more damage to the printed code at the cost of a denser code.
+var Levels = []string{"L", "M", "Q", "H"}
+
+var recoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// Options controls how a QR code is rendered.
+type Options struct {
+	// Size is the width and height of the code in pixels. Codes with more modules than pixels are
+	// rendered at one pixel per module instead.
+	Size int
+
+	// Margin is the width of the quiet zone around the code in modules.
+	Margin int
+
+	// Level is the error correction level, one of Levels.
+	Level string
+
+	Foreground color.RGBA
+	Background color.RGBA
+}
+
+// PNG renders content as a QR code PNG image.
+func PNG(content string, opts Options) ([]byte, error) {
+	modules, err := bitmap(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(modules) + 2*opts.Margin
+	scale := opts.Size / total
+	if scale < 1 {
+		scale = 1
+	}
+
+	size := opts.Size
+	if total*scale > size {
+		size = total * scale
+	}
+
+	// Centre the code, filling whatever is left over after scaling with the background.
+	offset := (size-total*scale)/2 + opts.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{opts.Background, opts.Foreground})
+
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SVG renders content as a QR code SVG document. The document scales to any size, Size only sets
+// its default width and height.
+func SVG(content string, opts Options) ([]byte, error) {
+	modules, err := bitmap(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(modules) + 2*opts.Margin
+
+	var path strings.Builder
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+opts.Margin, y+opts.Margin)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, opts.Size, opts.Size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, total, total, Hex(opts.Background))
+	fmt.Fprintf(&buf, `<path fill="%s" d="%s"/>`, Hex(opts.Foreground), path.String())
+	buf.WriteString("</svg>\n")
+
+	return buf.Bytes(), nil
+}
+
+// bitmap encodes content, returning the dark modules of the code without a quiet zone.
+func bitmap(content string, opts Options) ([][]bool, error) {
+	level, ok := recoveryLevels[opts.Level]
+	if !ok {
+		return nil, fmt.Errorf("qr: unknown error correction level %q", opts.Level)
+	}
+
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+
+	code.DisableBorder = true
+
+	return code.Bitmap(), nil
+}
+
+// ParseColor parses a colour in the hex form RRGGBB, with or without a leading #.
+func ParseColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("qr: invalid colour %q", s)
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("qr: invalid colour %q", s)
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// Hex formats a colour in the hex form #RRGGBB.
+func Hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
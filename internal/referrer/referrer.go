@@ -0,0 +1,98 @@
+// Package referrer normalises Referer headers into the host they came from, so that visits from
+// the same site are grouped together however the site linked to us.
+package referrer
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Direct is the host used for visits without a referrer, e.g. typed or bookmarked visits and
+// clicks from apps which don't send one.
+const Direct = "direct"
+
+// hostPrefixes are the subdomains stripped from hosts, as sites serve the same content from them
+// for different devices. At most one is stripped, and only from hosts with at least two labels
+// left after it, so that e.g. m.me and amp.dev are left alone.
+var hostPrefixes = []string{"www.", "m.", "mobile.", "amp.", "touch."}
+
+// aliases maps the hosts some sites redirect their outbound links through to the site itself.
+var aliases = map[string]string{
+	"l.facebook.com":        "facebook.com",
+	"lm.facebook.com":       "facebook.com",
+	"l.instagram.com":       "instagram.com",
+	"l.messenger.com":       "messenger.com",
+	"out.reddit.com":        "reddit.com",
+	"old.reddit.com":        "reddit.com",
+	"t.co":                  "twitter.com",
+	"x.com":                 "twitter.com",
+	"lnkd.in":               "linkedin.com",
+	"away.vk.com":           "vk.com",
+	"youtu.be":              "youtube.com",
+	"com.google.android.gm": "mail.google.com",
+}
+
+// googleDomains are the regional domains of Google, after the "google." label, which are grouped
+// as google.com.
+var googleDomains = map[string]bool{
+	"com": true, "ad": true, "ae": true, "al": true, "am": true, "as": true, "at": true, "az": true,
+	"ba": true, "be": true, "bg": true, "bj": true, "by": true, "ca": true, "cat": true, "cd": true,
+	"ch": true, "cl": true, "cm": true, "cn": true, "cz": true, "de": true, "dk": true, "dz": true,
+	"ee": true, "es": true, "fi": true, "fr": true, "ge": true, "gr": true, "hr": true, "hu": true,
+	"ie": true, "is": true, "it": true, "jo": true, "kz": true, "lk": true, "lt": true, "lu": true,
+	"lv": true, "md": true, "mk": true, "mn": true, "nl": true, "no": true, "pl": true, "pt": true,
+	"ro": true, "rs": true, "ru": true, "se": true, "si": true, "sk": true, "sn": true, "tn": true,
+	"co.id": true, "co.il": true, "co.in": true, "co.jp": true, "co.ke": true, "co.kr": true,
+	"co.nz": true, "co.th": true, "co.uk": true, "co.za": true, "co.ve": true,
+	"com.ar": true, "com.au": true, "com.bd": true, "com.br": true, "com.co": true, "com.eg": true,
+	"com.hk": true, "com.mx": true, "com.my": true, "com.ng": true, "com.pe": true, "com.ph": true,
+	"com.pk": true, "com.sa": true, "com.sg": true, "com.tr": true, "com.tw": true, "com.ua": true,
+	"com.vn": true,
+}
+
+// Host returns the normalised host of a referrer URL. Empty or unparseable referrers are
+// returned as Direct.
+func Host(referrer string) string {
+	referrer = strings.TrimSpace(referrer)
+	if referrer == "" {
+		return Direct
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return Direct
+	}
+
+	host := strings.ToLower(u.Host)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(host, ".")
+
+	for _, prefix := range hostPrefixes {
+		if rest := strings.TrimPrefix(host, prefix); rest != host {
+			if strings.Contains(rest, ".") {
+				host = rest
+			}
+			break
+		}
+	}
+
+	if alias, ok := aliases[host]; ok {
+		host = alias
+	}
+
+	// Group the regional domains of Google, e.g. google.co.uk and google.de.
+	if domain, ok := strings.CutPrefix(host, "google."); ok && googleDomains[domain] {
+		host = "google.com"
+	}
+
+	if host == "" {
+		return Direct
+	}
+
+	return host
+}
@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Counter is a snapshot of the live visit counters of a link. The counters only cover the
+// visits handled by this process while the link was watched.
+type Counter struct {
+	LinkID      uuid.UUID  `json:"link_id"`
+	Visits      int64      `json:"visits"`
+	LastMinute  int        `json:"visits_last_minute"`
+	LastHour    int        `json:"visits_last_hour"`
+	LastVisitAt *time.Time `json:"last_visit_at"`
+}
+
+// counterRetention is how long the counters of a link nobody watches any more are kept after its
+// last visit, so that a dashboard reconnecting doesn't find them reset.
+const counterRetention = time.Hour
+
+// Counters counts the visits of each watched link as they happen, so live dashboards don't need
+// to query the database. Visits of links nobody watches aren't counted.
+type Counters struct {
+	mu       sync.Mutex
+	links    map[uuid.UUID]*linkCounter
+	watchers map[uuid.UUID]int
+}
+
+// linkCounter counts the visits of a link in one-second buckets over the last minute and
+// one-minute buckets over the last hour. Each bucket remembers which second or minute it holds,
+// so stale buckets are ignored rather than needing to be cleared.
+type linkCounter struct {
+	total     int64
+	seconds   [60]bucket
+	minutes   [60]bucket
+	lastVisit time.Time
+}
+
+type bucket struct {
+	at    int64
+	count int
+}
+
+func NewCounters() *Counters {
+	return &Counters{links: map[uuid.UUID]*linkCounter{}, watchers: map[uuid.UUID]int{}}
+}
+
+// Watch starts counting the visits of a link, until each call has been matched by Unwatch.
+func (c *Counters) Watch(linkID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.watchers[linkID]++
+}
+
+// Unwatch undoes a call to Watch.
+func (c *Counters) Unwatch(linkID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watchers[linkID] <= 1 {
+		delete(c.watchers, linkID)
+		return
+	}
+
+	c.watchers[linkID]--
+}
+
+// Prune discards the counters of the links nobody watches whose last visit was over an hour
+// before now, returning the number discarded.
+func (c *Counters) Prune(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pruned := 0
+
+	for linkID, counter := range c.links {
+		if c.watchers[linkID] == 0 && now.Sub(counter.lastVisit) > counterRetention {
+			delete(c.links, linkID)
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+// Add counts a visit to a link made at the given time, if the link is watched.
+func (c *Counters) Add(linkID uuid.UUID, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watchers[linkID] == 0 {
+		return
+	}
+
+	counter, ok := c.links[linkID]
+	if !ok {
+		counter = &linkCounter{}
+		c.links[linkID] = counter
+	}
+
+	counter.total++
+	add(&counter.seconds, at.Unix())
+	add(&counter.minutes, at.Unix()/60)
+
+	if at.After(counter.lastVisit) {
+		counter.lastVisit = at
+	}
+}
+
+// Get returns a snapshot of the counters of a link at the given time.
+func (c *Counters) Get(linkID uuid.UUID, now time.Time) Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := Counter{LinkID: linkID}
+
+	counter, ok := c.links[linkID]
+	if !ok {
+		return snapshot
+	}
+
+	lastVisit := counter.lastVisit
+
+	snapshot.Visits = counter.total
+	snapshot.LastMinute = sum(&counter.seconds, now.Unix())
+	snapshot.LastHour = sum(&counter.minutes, now.Unix()/60)
+	snapshot.LastVisitAt = &lastVisit
+
+	return snapshot
+}
+
+func add(buckets *[60]bucket, at int64) {
+	b := &buckets[at%60]
+	if b.at != at {
+		*b = bucket{at: at}
+	}
+	b.count++
+}
+
+// sum adds up the buckets holding one of the 60 periods up to and including now.
+func sum(buckets *[60]bucket, now int64) int {
+	total := 0
+	for _, b := range buckets {
+		if b.at > now-60 && b.at <= now {
+			total += b.count
+		}
+	}
+	return total
+}
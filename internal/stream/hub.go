@@ -0,0 +1,148 @@
+// Package stream provides the in-process live views of visits: a publish/subscribe hub fanning
+// events out to the clients streaming them, and counters of each link's recent visits.
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber. A subscriber which falls
+// further behind than this is disconnected, and can resume from the last event it received.
+const subscriberBuffer = 64
+
+// eventIDStartBits is the number of low bits of event IDs counting the events published since the
+// hub was created, below the millisecond it was created at. IDs issued by a hub are then higher
+// than those of any hub created before it, unless that one published over a million events per
+// millisecond between them.
+const eventIDStartBits = 20
+
+// Event is an event published to the hub. IDs increase in the order events were published, and
+// keep increasing across restarts of the process.
+type Event struct {
+	ID     uint64
+	LinkID uuid.UUID
+	Type   string
+	Data   []byte
+}
+
+// Subscription receives the events of a link, or of every link. C is closed when the subscriber
+// is disconnected, either because it fell behind or because the hub was closed.
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	linkID uuid.UUID
+}
+
+// Hub fans published events out to subscribers, keeping a history of the most recent events so
+// that subscribers can resume after reconnecting.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	size    int
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewHub returns a hub which keeps the given number of recent events in its history.
+func NewHub(historySize int) *Hub {
+	firstID := uint64(time.Now().UnixMilli()) << eventIDStartBits
+
+	return &Hub{
+		nextID: firstID,
+		size:   historySize,
+		subs:   map[*Subscription]struct{}{},
+	}
+}
+
+// Publish publishes an event about a link to its subscribers and the subscribers of every link.
+func (h *Hub) Publish(linkID uuid.UUID, eventType string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	event := Event{ID: h.nextID, LinkID: linkID, Type: eventType, Data: data}
+	h.nextID++
+
+	h.history = append(h.history, event)
+	if len(h.history) > h.size {
+		h.history = h.history[len(h.history)-h.size:]
+	}
+
+	for sub := range h.subs {
+		if sub.linkID != uuid.Nil && sub.linkID != linkID {
+			continue
+		}
+
+		select {
+		case sub.c <- event:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+// Subscribe subscribes to the events of a link, or of every link if linkID is uuid.Nil. The
+// events after lastEventID which are still in the history are returned so they can be replayed
+// before any new events. A lastEventID of 0 replays nothing, and neither does an ID this hub
+// hasn't issued yet, e.g. one from another instance. An ID from before the hub was created, i.e.
+// from before a restart, replays the whole history, as every event in it is new to the client.
+func (h *Hub) Subscribe(linkID uuid.UUID, lastEventID uint64) (*Subscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: c, c: c, linkID: linkID}
+
+	if h.closed {
+		close(c)
+		return sub, nil
+	}
+
+	h.subs[sub] = struct{}{}
+
+	var missed []Event
+	if lastEventID > 0 && lastEventID < h.nextID {
+		for _, event := range h.history {
+			if event.ID > lastEventID && (linkID == uuid.Nil || event.LinkID == linkID) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return sub, missed
+}
+
+// Unsubscribe disconnects a subscriber. It is safe to call more than once.
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(sub)
+}
+
+// Close disconnects every subscriber and stops accepting new events.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+
+	for sub := range h.subs {
+		h.remove(sub)
+	}
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
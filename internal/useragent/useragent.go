@@ -0,0 +1,128 @@
+// Package useragent parses User-Agent headers into the browser, operating system and class of
+// device which made a request.
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device classes.
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+)
+
+// Other is used for any browser or operating system which could not be identified.
+const Other = "Other"
+
+// Devices lists every device class Parse returns.
+var Devices = []string{DeviceDesktop, DeviceMobile, DeviceTablet}
+
+// OperatingSystems lists every operating system family Parse returns.
+var OperatingSystems = []string{
+	"Windows", "Windows Phone", "iOS", "Android", "Chrome OS", "macOS", "Linux", "FreeBSD", Other,
+}
+
+// UserAgent holds the parsed details of a User-Agent header.
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	Device         string
+}
+
+// browserRule identifies a browser family by a regex whose first group captures the version.
+type browserRule struct {
+	family string
+	rx     *regexp.Regexp
+}
+
+// browserRules are checked in order. Most browsers also claim to be the browser they are based
+// on (e.g. Edge claims to be Chrome and Safari), so the more specific rules come first.
+var browserRules = []browserRule{
+	{"Facebook", regexp.MustCompile(`FBAV/([\d.]+)`)},
+	{"Instagram", regexp.MustCompile(`Instagram ([\d.]+)`)},
+	{"Edge", regexp.MustCompile(`(?:Edge|Edg|EdgA|EdgiOS)/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|OPiOS|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/([\d.]+)`)},
+	{"Yandex", regexp.MustCompile(`YaBrowser/([\d.]+)`)},
+	{"Vivaldi", regexp.MustCompile(`Vivaldi/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS|Chromium)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+// osRule identifies an operating system by a substring of the user agent.
+type osRule struct {
+	family string
+	marker string
+}
+
+// osRules are checked in order. iOS user agents contain "like Mac OS X" and Android user agents
+// contain "Linux", so those are checked first.
+var osRules = []osRule{
+	{"Windows Phone", "Windows Phone"},
+	{"Windows", "Windows"},
+	{"iOS", "iPhone"},
+	{"iOS", "iPad"},
+	{"iOS", "iPod"},
+	{"Android", "Android"},
+	{"Chrome OS", "CrOS"},
+	{"macOS", "Macintosh"},
+	{"macOS", "Mac OS X"},
+	{"Linux", "Linux"},
+	{"FreeBSD", "FreeBSD"},
+}
+
+var (
+	tabletRX = regexp.MustCompile(`iPad|Tablet|Kindle|Silk/|PlayBook|Nexus (?:7|9|10)`)
+	mobileRX = regexp.MustCompile(`Mobi|iPhone|iPod|Windows Phone|BlackBerry|Opera Mini`)
+)
+
+// Parse parses a User-Agent header. Fields which cannot be determined are set to Other, and the
+// device defaults to desktop.
+func Parse(ua string) UserAgent {
+	parsed := UserAgent{
+		Browser: Other,
+		OS:      Other,
+		Device:  DeviceDesktop,
+	}
+
+	for _, rule := range browserRules {
+		if match := rule.rx.FindStringSubmatch(ua); match != nil {
+			parsed.Browser = rule.family
+			parsed.BrowserVersion = majorVersion(match[1])
+			break
+		}
+	}
+
+	for _, rule := range osRules {
+		if strings.Contains(ua, rule.marker) {
+			parsed.OS = rule.family
+			break
+		}
+	}
+
+	switch {
+	case tabletRX.MatchString(ua):
+		parsed.Device = DeviceTablet
+	case mobileRX.MatchString(ua):
+		parsed.Device = DeviceMobile
+	// Android phones include "Mobile" in their user agent while Android tablets don't.
+	case parsed.OS == "Android":
+		parsed.Device = DeviceTablet
+	}
+
+	return parsed
+}
+
+// majorVersion trims a version number down to its major version, so that the many patch
+// releases of a browser are counted together.
+func majorVersion(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNonPublicAddress is returned when a webhook URL is, or resolves to, an address which isn't
+// reachable on the public internet, such as loopback, private or link-local addresses. Sending
+// requests there would let anyone who can create a webhook probe the network the API runs in.
+var ErrNonPublicAddress = errors.New("webhook: address is not public")
+
+// nonPublicPrefixes are the special purpose ranges which aren't covered by the netip.Addr
+// predicates used in IsPublic.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which can embed any IPv4 address
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+}
+
+// IsPublic reports whether ip is a globally routable unicast address.
+func IsPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	if !ip.IsValid() || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckHost returns ErrNonPublicAddress if the host of a webhook URL is, or resolves to, an
+// address which isn't public. Every address the host resolves to must be public, as any of them
+// may be the one connected to.
+func CheckHost(ctx context.Context, resolver *net.Resolver, host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrNonPublicAddress
+	}
+
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		if !IsPublic(ip) {
+			return ErrNonPublicAddress
+		}
+		return nil
+	}
+
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("webhook: resolving %s: %w", host, err)
+	}
+
+	for _, ip := range ips {
+		if !IsPublic(ip) {
+			return ErrNonPublicAddress
+		}
+	}
+
+	return nil
+}
+
+// NewClient returns a client for sending webhook requests which refuses to connect to addresses
+// which aren't public. The address is checked as the connection is made, after it has been
+// resolved, so a hostname which passed CheckHost and was later pointed at an internal address
+// is still refused, including when reached through a redirect.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !IsPublic(addrPort.Addr()) {
+				return ErrNonPublicAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	// Requests are never sent through a proxy, as the address checked would be the proxy's.
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
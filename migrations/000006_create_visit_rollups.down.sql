@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS visit_rollup_state;
+DROP TABLE IF EXISTS visits_daily;
+DROP TABLE IF EXISTS visits_hourly;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS visits_hourly
+(
+  link_id   uuid NOT NULL,
+  bucket    TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+  visits    BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (link_id, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS visits_daily
+(
+  link_id   uuid NOT NULL,
+  bucket    DATE NOT NULL,
+  visits    BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (link_id, bucket)
+);
+
+-- Single row table holding the rollup watermark. Visits created before rolled_up_until have been
+-- folded into the rollup tables, anything after it is the un-rolled tail.
+CREATE TABLE IF NOT EXISTS visit_rollup_state
+(
+  id               BOOLEAN DEFAULT TRUE CHECK (id),
+  rolled_up_until  TIMESTAMP(0) WITH TIME ZONE,
+  PRIMARY KEY (id)
+);
+
+INSERT INTO visit_rollup_state (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
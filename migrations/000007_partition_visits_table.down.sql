@@ -0,0 +1,23 @@
+ALTER TABLE visits RENAME TO visits_partitioned;
+ALTER TABLE visits_partitioned RENAME CONSTRAINT visits_pkey TO visits_partitioned_pkey;
+ALTER INDEX visits_link_id_idx RENAME TO visits_partitioned_link_id_idx;
+
+CREATE TABLE IF NOT EXISTS visits
+(
+  id              uuid DEFAULT uuid_generate_v4 (),
+  link_id         uuid NOT NULL,
+  created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  referrer        TEXT,
+  remote_address  TEXT,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS visits_link_id_idx
+	ON visits(link_id);
+
+INSERT INTO visits (id, link_id, created_at, referrer, remote_address)
+SELECT id, link_id, created_at, referrer, remote_address
+FROM visits_partitioned;
+
+-- Dropping the partitioned table drops all of its partitions.
+DROP TABLE visits_partitioned;
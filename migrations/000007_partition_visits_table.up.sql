@@ -0,0 +1,43 @@
+ALTER TABLE visits RENAME TO visits_unpartitioned;
+ALTER TABLE visits_unpartitioned RENAME CONSTRAINT visits_pkey TO visits_unpartitioned_pkey;
+ALTER INDEX visits_link_id_idx RENAME TO visits_unpartitioned_link_id_idx;
+
+-- The partition key has to be part of the primary key of a partitioned table.
+CREATE TABLE IF NOT EXISTS visits
+(
+  id              uuid DEFAULT uuid_generate_v4 (),
+  link_id         uuid NOT NULL,
+  created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  referrer        TEXT,
+  remote_address  TEXT,
+  PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+CREATE INDEX IF NOT EXISTS visits_link_id_idx
+	ON visits(link_id, created_at);
+
+-- Catches visits outside of the monthly partitions (e.g. backdated imports) so inserts never fail.
+CREATE TABLE IF NOT EXISTS visits_default PARTITION OF visits DEFAULT;
+
+-- Create a monthly partition for every month with existing visits, up to and including next
+-- month. The API keeps creating partitions ahead of time from then on.
+DO $$
+DECLARE
+  month TIMESTAMP WITH TIME ZONE;
+BEGIN
+  month := date_trunc('month', LEAST((SELECT min(created_at) FROM visits_unpartitioned), NOW()));
+
+  WHILE month <= date_trunc('month', NOW()) + interval '1 month' LOOP
+    EXECUTE format(
+      'CREATE TABLE IF NOT EXISTS %I PARTITION OF visits FOR VALUES FROM (%L) TO (%L)',
+      'visits_' || to_char(month, 'YYYY_MM'), month, month + interval '1 month'
+    );
+    month := month + interval '1 month';
+  END LOOP;
+END $$;
+
+INSERT INTO visits (id, link_id, created_at, referrer, remote_address)
+SELECT id, link_id, created_at, referrer, remote_address
+FROM visits_unpartitioned;
+
+DROP TABLE visits_unpartitioned;
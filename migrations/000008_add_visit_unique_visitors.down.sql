@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS visitor_salts;
+
+ALTER TABLE visits_daily DROP COLUMN IF EXISTS visitors;
+ALTER TABLE visits_hourly DROP COLUMN IF EXISTS visitors;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS visitor_hash;
+ALTER TABLE visits DROP COLUMN IF EXISTS user_agent;
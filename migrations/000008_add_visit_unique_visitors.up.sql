@@ -0,0 +1,14 @@
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS user_agent TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS visitor_hash BIGINT;
+
+ALTER TABLE visits_hourly ADD COLUMN IF NOT EXISTS visitors BYTEA;
+ALTER TABLE visits_daily ADD COLUMN IF NOT EXISTS visitors BYTEA;
+
+-- Random salts for hashing visitors. Old salts are deleted so that visitor hashes cannot be
+-- linked across days or reversed once the day has passed.
+CREATE TABLE IF NOT EXISTS visitor_salts
+(
+  day   DATE NOT NULL,
+  salt  BYTEA NOT NULL,
+  PRIMARY KEY (day)
+);
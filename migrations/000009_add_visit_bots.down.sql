@@ -0,0 +1,11 @@
+DELETE FROM visits_daily WHERE is_bot;
+ALTER TABLE visits_daily DROP CONSTRAINT IF EXISTS visits_daily_pkey;
+ALTER TABLE visits_daily ADD PRIMARY KEY (link_id, bucket);
+ALTER TABLE visits_daily DROP COLUMN IF EXISTS is_bot;
+
+DELETE FROM visits_hourly WHERE is_bot;
+ALTER TABLE visits_hourly DROP CONSTRAINT IF EXISTS visits_hourly_pkey;
+ALTER TABLE visits_hourly ADD PRIMARY KEY (link_id, bucket);
+ALTER TABLE visits_hourly DROP COLUMN IF EXISTS is_bot;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS is_bot;
@@ -0,0 +1,10 @@
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Bot and human visits are rolled up separately, so either can be excluded from the analytics.
+ALTER TABLE visits_hourly ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE visits_hourly DROP CONSTRAINT IF EXISTS visits_hourly_pkey;
+ALTER TABLE visits_hourly ADD PRIMARY KEY (link_id, bucket, is_bot);
+
+ALTER TABLE visits_daily ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE visits_daily DROP CONSTRAINT IF EXISTS visits_daily_pkey;
+ALTER TABLE visits_daily ADD PRIMARY KEY (link_id, bucket, is_bot);
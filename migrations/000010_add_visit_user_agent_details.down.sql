@@ -0,0 +1,4 @@
+ALTER TABLE visits DROP COLUMN IF EXISTS device;
+ALTER TABLE visits DROP COLUMN IF EXISTS os;
+ALTER TABLE visits DROP COLUMN IF EXISTS browser_version;
+ALTER TABLE visits DROP COLUMN IF EXISTS browser;
@@ -0,0 +1,4 @@
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS browser TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS browser_version TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS os TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS device TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE visits DROP COLUMN IF EXISTS city;
+ALTER TABLE visits DROP COLUMN IF EXISTS region;
+ALTER TABLE visits DROP COLUMN IF EXISTS country;
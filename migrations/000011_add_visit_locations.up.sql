@@ -0,0 +1,3 @@
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS country TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS region TEXT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS city TEXT;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS visits_referrer_host_idx;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS referrer_host;
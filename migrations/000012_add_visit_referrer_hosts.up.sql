@@ -0,0 +1,7 @@
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS referrer_host TEXT;
+
+UPDATE visits SET referrer_host = 'direct'
+WHERE referrer_host IS NULL AND (referrer IS NULL OR referrer = '');
+
+CREATE INDEX IF NOT EXISTS visits_referrer_host_idx
+	ON visits(link_id, referrer_host, created_at);
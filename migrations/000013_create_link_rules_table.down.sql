@@ -0,0 +1,3 @@
+ALTER TABLE visits DROP COLUMN IF EXISTS rule_id;
+
+DROP TABLE IF EXISTS link_rules;
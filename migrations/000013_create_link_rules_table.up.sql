@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS link_rules
+(
+  id                 uuid DEFAULT uuid_generate_v4 (),
+  link_id            uuid NOT NULL REFERENCES links ON DELETE CASCADE,
+  position           INTEGER NOT NULL,
+  destination        TEXT NOT NULL,
+  countries          TEXT[] NOT NULL DEFAULT '{}',
+  devices            TEXT[] NOT NULL DEFAULT '{}',
+  operating_systems  TEXT[] NOT NULL DEFAULT '{}',
+  languages          TEXT[] NOT NULL DEFAULT '{}',
+  starts_at          TIMESTAMP(0) WITH TIME ZONE,
+  ends_at            TIMESTAMP(0) WITH TIME ZONE,
+  created_at         TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at         TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  version            INTEGER NOT NULL DEFAULT 1,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS link_rules_link_id_idx
+	ON link_rules(link_id, position);
+
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS rule_id uuid;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS visits_daily_variants;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS variant_id;
+
+DROP TABLE IF EXISTS link_destinations;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS link_destinations
+(
+  id           uuid DEFAULT uuid_generate_v4 (),
+  link_id      uuid NOT NULL REFERENCES links ON DELETE CASCADE,
+  destination  TEXT NOT NULL,
+  weight       INTEGER NOT NULL CHECK (weight > 0),
+  created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  version      INTEGER NOT NULL DEFAULT 1,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS link_destinations_link_id_idx
+	ON link_destinations(link_id);
+
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS variant_id uuid;
+
+-- Daily visit counts per split destination, maintained alongside the other rollups.
+CREATE TABLE IF NOT EXISTS visits_daily_variants
+(
+  link_id     uuid NOT NULL,
+  variant_id  uuid NOT NULL,
+  bucket      DATE NOT NULL,
+  is_bot      BOOLEAN NOT NULL DEFAULT FALSE,
+  visits      BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (link_id, variant_id, bucket, is_bot)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS conversions
+(
+  id          uuid DEFAULT uuid_generate_v4 (),
+  visit_id    uuid NOT NULL,
+  link_id     uuid NOT NULL,
+  goal        TEXT NOT NULL,
+  value       NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (id),
+  UNIQUE (visit_id, goal)
+);
+
+CREATE INDEX IF NOT EXISTS conversions_link_id_idx
+	ON conversions(link_id, goal);
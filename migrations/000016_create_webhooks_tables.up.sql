@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS webhooks
+(
+  id          uuid DEFAULT uuid_generate_v4 (),
+  url         TEXT NOT NULL,
+  secret      TEXT NOT NULL,
+  events      TEXT[] NOT NULL DEFAULT '{}',
+  active      BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  version     INTEGER NOT NULL DEFAULT 1,
+  PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+  id                uuid DEFAULT uuid_generate_v4 (),
+  webhook_id        uuid NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+  event             TEXT NOT NULL,
+  payload           JSONB NOT NULL,
+  status            TEXT NOT NULL DEFAULT 'pending',
+  attempts          INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_attempt_at   TIMESTAMP(0) WITH TIME ZONE,
+  response_status   INTEGER,
+  last_error        TEXT,
+  created_at        TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx
+	ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx
+	ON webhook_deliveries(webhook_id, created_at);
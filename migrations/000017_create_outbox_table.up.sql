@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS outbox
+(
+  id          BIGSERIAL,
+  link_id     uuid NOT NULL,
+  event       TEXT NOT NULL,
+  payload     JSONB NOT NULL,
+  created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (id)
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS links_domain_id_token_key;
+DROP INDEX IF EXISTS links_token_key;
+
+ALTER TABLE links DROP COLUMN IF EXISTS domain_id;
+ALTER TABLE links ADD CONSTRAINT links_token_key UNIQUE (token);
+
+DROP TABLE IF EXISTS domains;
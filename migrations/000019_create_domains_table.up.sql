@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS domains
+(
+  id            uuid DEFAULT uuid_generate_v4 (),
+  hostname      TEXT NOT NULL,
+  fallback_url  TEXT NOT NULL DEFAULT '',
+  status        TEXT NOT NULL DEFAULT 'pending',
+  verified_at   TIMESTAMP(0) WITH TIME ZONE,
+  created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  version       INTEGER NOT NULL DEFAULT 1,
+  PRIMARY KEY (id),
+  CONSTRAINT domains_hostname_key UNIQUE (hostname)
+);
+
+-- Links without a domain are served from the default domain. Tokens only need to be unique within
+-- a domain, so the same token can be used on several domains.
+ALTER TABLE links ADD COLUMN IF NOT EXISTS domain_id uuid REFERENCES domains ON DELETE RESTRICT;
+
+ALTER TABLE links DROP CONSTRAINT IF EXISTS links_token_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS links_token_key
+	ON links(token) WHERE domain_id IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS links_domain_id_token_key
+	ON links(domain_id, token) WHERE domain_id IS NOT NULL;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS domains_pending_next_check_at_idx;
+
+ALTER TABLE domains
+	DROP COLUMN IF EXISTS checked_at,
+	DROP COLUMN IF EXISTS next_check_at,
+	DROP COLUMN IF EXISTS verification_started_at,
+	DROP COLUMN IF EXISTS verification_error,
+	DROP COLUMN IF EXISTS verification_token;
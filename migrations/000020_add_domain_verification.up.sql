@@ -0,0 +1,12 @@
+-- Domains are verified by publishing their verification token in a TXT record. Pending domains
+-- are re-checked at next_check_at until they are verified, or fail once the verification window
+-- since verification_started_at has passed.
+ALTER TABLE domains
+	ADD COLUMN IF NOT EXISTS verification_token TEXT NOT NULL DEFAULT md5(random()::text),
+	ADD COLUMN IF NOT EXISTS verification_error TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS verification_started_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	ADD COLUMN IF NOT EXISTS next_check_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	ADD COLUMN IF NOT EXISTS checked_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS domains_pending_next_check_at_idx
+	ON domains(next_check_at) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS links_created_at_idx;
+DROP INDEX IF EXISTS links_token_trgm_idx;
+DROP INDEX IF EXISTS links_destination_trgm_idx;
+DROP INDEX IF EXISTS links_name_trgm_idx;
@@ -0,0 +1,12 @@
+-- Trigram indexes serve the fuzzy and substring matches of link searches.
+CREATE INDEX IF NOT EXISTS links_name_trgm_idx
+	ON links USING GIN (name gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS links_destination_trgm_idx
+	ON links USING GIN (destination gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS links_token_trgm_idx
+	ON links USING GIN (token gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS links_created_at_idx
+	ON links(created_at);
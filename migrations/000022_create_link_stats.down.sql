@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS link_daily_visits;
+DROP TABLE IF EXISTS link_stats;
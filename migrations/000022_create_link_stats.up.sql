@@ -0,0 +1,58 @@
+-- Visit counters of each link, kept up to date as visits are recorded so that links can be sorted
+-- by popularity without counting their visits. Visits by bots aren't counted.
+CREATE TABLE IF NOT EXISTS link_stats
+(
+  link_id          uuid NOT NULL REFERENCES links ON DELETE CASCADE,
+  total_visits     BIGINT NOT NULL DEFAULT 0,
+  visits_7d        BIGINT NOT NULL DEFAULT 0,
+  last_visited_at  TIMESTAMP(0) WITH TIME ZONE,
+  PRIMARY KEY (link_id)
+);
+
+-- Visits per link and day over the last week, from which visits_7d is recounted as days fall out
+-- of the window.
+CREATE TABLE IF NOT EXISTS link_daily_visits
+(
+  link_id  uuid NOT NULL REFERENCES links ON DELETE CASCADE,
+  day      DATE NOT NULL,
+  visits   BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (link_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS link_stats_total_visits_idx ON link_stats(total_visits, link_id);
+CREATE INDEX IF NOT EXISTS link_stats_visits_7d_idx ON link_stats(visits_7d, link_id);
+CREATE INDEX IF NOT EXISTS link_stats_last_visited_at_idx ON link_stats(last_visited_at, link_id);
+
+-- Count the existing visits, taking the totals from the rollups as raw visits may have expired.
+INSERT INTO link_daily_visits (link_id, day, visits)
+SELECT link_id, CAST(created_at as DATE), count(*)
+FROM visits
+WHERE is_bot = FALSE AND created_at >= CURRENT_DATE - 6
+GROUP BY 1, 2
+ON CONFLICT DO NOTHING;
+
+INSERT INTO link_stats (link_id, total_visits, visits_7d, last_visited_at)
+SELECT
+  links.id,
+  (
+    SELECT COALESCE(sum(visits), 0)
+    FROM visits_daily
+    WHERE visits_daily.link_id = links.id AND visits_daily.is_bot = FALSE
+  ) + (
+    SELECT count(*)
+    FROM visits
+    WHERE visits.link_id = links.id AND visits.is_bot = FALSE
+    AND created_at >= COALESCE((SELECT rolled_up_until FROM visit_rollup_state), '-infinity')
+  ),
+  (
+    SELECT COALESCE(sum(visits), 0)
+    FROM link_daily_visits
+    WHERE link_daily_visits.link_id = links.id
+  ),
+  (
+    SELECT max(created_at)
+    FROM visits
+    WHERE visits.link_id = links.id AND visits.is_bot = FALSE
+  )
+FROM links
+ON CONFLICT DO NOTHING;
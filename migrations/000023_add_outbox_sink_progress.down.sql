@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS webhook_deliveries_event_id_idx;
+
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS event_id;
+
+ALTER TABLE outbox DROP COLUMN IF EXISTS published_to;
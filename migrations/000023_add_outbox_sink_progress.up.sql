@@ -0,0 +1,6 @@
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS published_to TEXT[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id BIGINT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_id_idx
+	ON webhook_deliveries(webhook_id, event_id);
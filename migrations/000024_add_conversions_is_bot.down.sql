@@ -0,0 +1 @@
+ALTER TABLE conversions DROP COLUMN IF EXISTS is_bot;
@@ -0,0 +1,7 @@
+ALTER TABLE conversions ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Conversions of bot visits are excluded from the conversion rate along with the visits.
+UPDATE conversions
+SET is_bot = visits.is_bot
+FROM visits
+WHERE visits.id = conversions.visit_id AND visits.is_bot;
@@ -0,0 +1,10 @@
+-- Visits waiting to be added to their link's counters. Redirects only append here, rather than
+-- updating the link's row in link_stats, so that concurrent visits of a popular link don't queue
+-- up on its row lock. The increments are folded into the counters in batches in the background.
+CREATE TABLE IF NOT EXISTS link_visit_increments
+(
+  id          BIGSERIAL,
+  link_id     uuid NOT NULL REFERENCES links ON DELETE CASCADE,
+  created_at  TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (id)
+);
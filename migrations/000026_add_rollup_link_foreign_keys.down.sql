@@ -0,0 +1,3 @@
+ALTER TABLE visits_daily_variants DROP CONSTRAINT IF EXISTS visits_daily_variants_link_id_fkey;
+ALTER TABLE visits_daily DROP CONSTRAINT IF EXISTS visits_daily_link_id_fkey;
+ALTER TABLE visits_hourly DROP CONSTRAINT IF EXISTS visits_hourly_link_id_fkey;
@@ -0,0 +1,11 @@
+-- The rollups of deleted links were left behind, so drop them before enforcing the references.
+DELETE FROM visits_hourly WHERE NOT EXISTS (SELECT 1 FROM links WHERE links.id = visits_hourly.link_id);
+DELETE FROM visits_daily WHERE NOT EXISTS (SELECT 1 FROM links WHERE links.id = visits_daily.link_id);
+DELETE FROM visits_daily_variants WHERE NOT EXISTS (SELECT 1 FROM links WHERE links.id = visits_daily_variants.link_id);
+
+ALTER TABLE visits_hourly
+  ADD CONSTRAINT visits_hourly_link_id_fkey FOREIGN KEY (link_id) REFERENCES links ON DELETE CASCADE;
+ALTER TABLE visits_daily
+  ADD CONSTRAINT visits_daily_link_id_fkey FOREIGN KEY (link_id) REFERENCES links ON DELETE CASCADE;
+ALTER TABLE visits_daily_variants
+  ADD CONSTRAINT visits_daily_variants_link_id_fkey FOREIGN KEY (link_id) REFERENCES links ON DELETE CASCADE;